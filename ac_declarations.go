@@ -10,15 +10,17 @@ import (
 )
 
 type DeclarationsArgs struct {
-	Fn     string            `json:"filename"`
-	Src    string            `json:"src"`
-	PkgDir string            `json:"pkg_dir"`
-	Env    map[string]string `json:"env"`
+	Fn         string            `json:"filename"`
+	Src        string            `json:"src"`
+	PkgDir     string            `json:"pkg_dir"`
+	Env        map[string]string `json:"env"`
+	DotImports bool              `json:"dot_imports"`
 }
 
 type DeclarationsRes struct {
 	FileDecls []*Decl `json:"file_decls"`
 	PkgDecls  []*Decl `json:"pkg_decls"`
+	DotDecls  []*Decl `json:"dot_decls"`
 }
 
 type Decl struct {
@@ -33,12 +35,18 @@ type Decl struct {
 func init() {
 	act(Action{
 		Path: "/declarations",
-		Doc:  "",
+		Doc: `
+lists the declarations in the file filename (or src) and, if pkg_dir is set, the package in that dir or with that import path
+@data: {"filename": "...", "src": "...", "pkg_dir": "", "env": {}, "dot_imports": false}
+@resp: {"file_decls": [{"name": "", "repr": "", "kind": "", "fn": "", "row": 0, "col": 0}], "pkg_decls": [], "dot_decls": []}
+if dot_imports is true, dot_decls lists the exported names that the file's dot imports (import . "path") bring into scope
+`,
 		Func: func(r Request) (data, error) {
 			a := DeclarationsArgs{}
 			res := DeclarationsRes{
 				FileDecls: []*Decl{},
 				PkgDecls:  []*Decl{},
+				DotDecls:  []*Decl{},
 			}
 
 			if err := r.Decode(&a); err != nil {
@@ -47,6 +55,19 @@ func init() {
 
 			if fset, af, err := parseAstFile(a.Fn, a.Src, 0); err == nil {
 				res.FileDecls = collectDecls(fset, af, res.FileDecls)
+
+				if a.DotImports {
+					// only the exported, package-level names are brought into scope by a dot import
+					for _, pkg := range dotImportPkgs(fset, af, rootDirs(a.Env), 0) {
+						for _, f := range pkg.Files {
+							for _, d := range collectDecls(fset, f, nil) {
+								if ast.IsExported(d.Name) && d.Repr == "" {
+									res.DotDecls = append(res.DotDecls, d)
+								}
+							}
+						}
+					}
+				}
 			}
 
 			fset := token.NewFileSet()
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"go/ast"
+	"go/doc/comment"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"path"
 	"path/filepath"
 	"runtime"
@@ -11,14 +14,20 @@ import (
 	"strings"
 )
 
+// Doc describes a declaration. Src is its source, including its doc comment.
+// Decl is the declaration alone, without the comment or function body and Comment is the text of the doc comment.
+// Rendered is the doc comment rendered in the format requested
 type Doc struct {
-	Src  string `json:"src"`
-	Pkg  string `json:"pkg"`
-	Name string `json:"name"`
-	Kind string `json:"kind"`
-	Fn   string `json:"fn"`
-	Row  int    `json:"row"`
-	Col  int    `json:"col"`
+	Src      string `json:"src"`
+	Pkg      string `json:"pkg"`
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Fn       string `json:"fn"`
+	Row      int    `json:"row"`
+	Col      int    `json:"col"`
+	Decl     string `json:"decl"`
+	Comment  string `json:"comment"`
+	Rendered string `json:"rendered"`
 }
 
 type DocArgs struct {
@@ -29,12 +38,19 @@ type DocArgs struct {
 	Offset    int               `json:"offset"`
 	TabIndent bool              `json:"tab_indent"`
 	TabWidth  int               `json:"tab_width"`
+	Format    string            `json:"format"`
 }
 
 func init() {
 	act(Action{
 		Path: "/doc",
-		Doc:  "",
+		Doc: `
+finds the declaration of the identifier at offset in the file fn (whose content is src, if set), and its examples
+@data: {"fn": "...", "src": "...", "offset": 0, "env": {}, "tab_indent": true, "tab_width": 8, "format": ""}
+@resp: [{"src": "...", "pkg": "", "name": "", "kind": "", "fn": "", "row": 0, "col": 0, "decl": "", "comment": "", "rendered": ""}]
+decl is the declaration (signature) without its doc comment or body, and comment is the text of the doc comment.
+if format is one of text, markdown or html, rendered is the doc comment rendered in that format following the go/doc conventions
+`,
 		Func: func(r Request) (data, error) {
 			res := []*Doc{}
 
@@ -43,6 +59,11 @@ func init() {
 			if err := r.Decode(&a); err != nil {
 				return res, err
 			}
+			switch a.Format {
+			case "", "text", "markdown", "html":
+			default:
+				return res, errors.New("unknown format: " + a.Format)
+			}
 
 			fset, af, err := parseAstFile(a.Fn, a.Src, parser.ParseComments)
 			if err != nil {
@@ -72,9 +93,19 @@ func init() {
 			}
 			pkgs[pkg.Name] = pkg
 
-			obj, pkg, objPkgs := findUnderlyingObj(fset, af, pkg, pkgs, rootDirs(a.Env), sel, id)
+			var obj *ast.Object
+			var objPkgs map[string]*ast.Package
+			if id.Obj == nil {
+				// selectors on values, and chains of them, can only be resolved by type-checking
+				if tfset, tobj, tpkg, tpkgs := findTypedObj(a.Env, a.Fn, a.Src, a.Offset); tobj != nil {
+					fset, obj, pkg, objPkgs = tfset, tobj, tpkg, tpkgs
+				}
+			}
+			if obj == nil {
+				obj, pkg, objPkgs = findUnderlyingObj(fset, af, pkg, pkgs, rootDirs(a.Env), sel, id)
+			}
 			if obj != nil {
-				res = append(res, objDoc(fset, pkg, a.TabIndent, a.TabWidth, obj))
+				res = append(res, objDoc(fset, pkg, a.TabIndent, a.TabWidth, a.Format, obj))
 				if objPkgs != nil {
 					xName := "Example" + obj.Name
 					xPrefix := xName + "_"
@@ -86,7 +117,7 @@ func init() {
 
 						for _, xObj := range xPkg.Scope.Objects {
 							if xObj.Name == xName || strings.HasPrefix(xObj.Name, xPrefix) {
-								res = append(res, objDoc(fset, xPkg, a.TabIndent, a.TabWidth, xObj))
+								res = append(res, objDoc(fset, xPkg, a.TabIndent, a.TabWidth, a.Format, xObj))
 							}
 						}
 					}
@@ -97,7 +128,7 @@ func init() {
 	})
 }
 
-func objDoc(fset *token.FileSet, pkg *ast.Package, tabIndent bool, tabWidth int, obj *ast.Object) *Doc {
+func objDoc(fset *token.FileSet, pkg *ast.Package, tabIndent bool, tabWidth int, format string, obj *ast.Object) *Doc {
 	decl := obj.Decl
 	kind := obj.Kind.String()
 	tp := fset.Position(obj.Pos())
@@ -138,10 +169,14 @@ func objDoc(fset *token.FileSet, pkg *ast.Package, tabIndent bool, tabWidth int,
 	}
 
 	if objSrc == "" {
-		objSrc, _ = printSrc(fset, decl, tabIndent, tabWidth)
+		if v, ok := decl.(*ast.Field); ok {
+			objSrc = fieldSrc(fset, v, tabIndent, tabWidth)
+		} else {
+			objSrc, _ = printSrc(fset, decl, tabIndent, tabWidth)
+		}
 	}
 
-	return &Doc{
+	d := &Doc{
 		Src:  objSrc,
 		Pkg:  pkgName,
 		Name: obj.Name,
@@ -150,6 +185,226 @@ func objDoc(fset *token.FileSet, pkg *ast.Package, tabIndent bool, tabWidth int,
 		Row:  tp.Line - 1,
 		Col:  tp.Column - 1,
 	}
+	d.Decl, d.Comment = declSignature(fset, obj, tabIndent, tabWidth)
+	if format != "" && d.Comment != "" {
+		var af *ast.File
+		if pkg != nil {
+			af = pkg.Files[tp.Filename]
+		}
+		d.Rendered = renderDocComment(d.Comment, format, pkg, af)
+	}
+	return d
+}
+
+// declSignature returns the declaration of obj without its doc comment or function body, and the text of the doc comment
+func declSignature(fset *token.FileSet, obj *ast.Object, tabIndent bool, tabWidth int) (decl, comment string) {
+	var doc *ast.CommentGroup
+	var node interface{}
+	switch v := obj.Decl.(type) {
+	case *ast.FuncDecl:
+		fd := *v
+		doc, fd.Doc, fd.Body = v.Doc, nil, nil
+		node = &fd
+	case *ast.TypeSpec:
+		ts := *v
+		doc, ts.Doc, ts.Comment = v.Doc, nil, nil
+		if obj.Kind == ast.Pkg {
+			return "package " + obj.Name, doc.Text()
+		}
+		node = &ast.GenDecl{Tok: token.TYPE, Specs: []ast.Spec{&ts}}
+	case *ast.ValueSpec:
+		vs := *v
+		doc, vs.Doc, vs.Comment = v.Doc, nil, nil
+		tok := token.VAR
+		if obj.Kind == ast.Con {
+			tok = token.CONST
+		}
+		node = &ast.GenDecl{Tok: tok, Specs: []ast.Spec{&vs}}
+	case *ast.Field:
+		f := *v
+		doc, f.Doc, f.Comment = v.Doc, nil, nil
+		return fieldSrc(fset, &f, tabIndent, tabWidth), doc.Text()
+	default:
+		return "", ""
+	}
+	decl, _ = printSrc(fset, node, tabIndent, tabWidth)
+	return decl, doc.Text()
+}
+
+// renderDocComment renders the doc comment text as text, markdown or html.
+// Doc links e.g. [Name] or [pkg.Name] are resolved using the declarations in pkg and the imports of af, either may be nil
+func renderDocComment(text, format string, pkg *ast.Package, af *ast.File) string {
+	p := &comment.Parser{
+		LookupPackage: func(name string) (importPath string, ok bool) {
+			if af != nil {
+				for _, ispec := range af.Imports {
+					if specName(ispec) == name {
+						return unquote(ispec.Path.Value), true
+					}
+				}
+			}
+			return "", false
+		},
+		LookupSym: func(recv, name string) bool {
+			if pkg == nil {
+				return false
+			}
+			if recv != "" {
+				name = recv
+			}
+			for _, f := range pkg.Files {
+				if f.Scope != nil && f.Scope.Lookup(name) != nil {
+					return true
+				}
+			}
+			return pkg.Scope != nil && pkg.Scope.Lookup(name) != nil
+		},
+	}
+	pr := &comment.Printer{}
+	d := p.Parse(text)
+	switch format {
+	case "markdown":
+		return string(pr.Markdown(d))
+	case "html":
+		return string(pr.HTML(d))
+	}
+	return string(pr.Text(d))
+}
+
+// findTypedObj type-checks the package containing fn and returns the declaration of the object
+// referred to by the identifier at offset in src, the package it's declared in and, if it's declared
+// at the package level, the packages in its dir (used to find its examples).
+// Their positions are relative to the returned FileSet
+func findTypedObj(env map[string]string, fn, src string, offset int) (*token.FileSet, *ast.Object, *ast.Package, map[string]*ast.Package) {
+	tc, err := typeCheck(env, fn, src, nil)
+	if err != nil {
+		return nil, nil, nil, nil
+	}
+
+	typeCheckLck.Lock()
+	defer typeCheckLck.Unlock()
+
+	_, id := identAt(tc.Fset, tc.File, offset)
+	if id == nil {
+		return nil, nil, nil, nil
+	}
+	tobj := tc.Info.Uses[id]
+	if tobj == nil {
+		tobj = tc.Info.Defs[id]
+	}
+	if tobj == nil || tobj.Pkg() == nil {
+		return nil, nil, nil, nil
+	}
+	if _, ok := tobj.(*types.PkgName); ok {
+		// the package doc is handled by findUnderlyingObj
+		return nil, nil, nil, nil
+	}
+
+	obj, af := typeObjDecl(tc.Fset, tobj)
+	if obj == nil {
+		return nil, nil, nil, nil
+	}
+	filename := tc.Fset.Position(obj.Pos()).Filename
+	pkg := typeObjAstPkg(tobj, filename, af)
+
+	var pkgs map[string]*ast.Package
+	if tobj.Parent() == tobj.Pkg().Scope() {
+		pkgs, _ = parser.ParseDir(tc.Fset, filepath.Dir(filename), fiHasGoExt, parser.ParseComments)
+	}
+	return tc.Fset, obj, pkg, pkgs
+}
+
+// typeObjAstPkg returns the package tobj is declared in, as an ast.Package containing the file af (named filename)
+// and the other files of the package seen by the type checker
+func typeObjAstPkg(tobj types.Object, filename string, af *ast.File) *ast.Package {
+	pkg := &ast.Package{
+		Name:  tobj.Pkg().Name(),
+		Files: map[string]*ast.File{filename: af},
+	}
+	// the other files are used to resolve links in the doc comment.
+	// files may have been parsed more than once, in which case the latest is used
+	dir := filepath.Dir(filename)
+	bases := map[string]int{}
+	for tf, f := range typeCheckFiles {
+		fn := tf.Name()
+		if fn == filename || filepath.Dir(fn) != dir || f.Name.Name != pkg.Name || tf.Base() < bases[fn] {
+			continue
+		}
+		bases[fn] = tf.Base()
+		pkg.Files[fn] = f
+	}
+	return pkg
+}
+
+// typeObjDoc returns the Doc of the type-checked object tobj. If its declaration can't be found
+// e.g. because it's predeclared, the Doc is made from its type
+func typeObjDoc(fset *token.FileSet, tobj types.Object, tabIndent bool, tabWidth int) *Doc {
+	if obj, af := typeObjDecl(fset, tobj); obj != nil && tobj.Pkg() != nil {
+		pkg := typeObjAstPkg(tobj, fset.Position(obj.Pos()).Filename, af)
+		return objDoc(fset, pkg, tabIndent, tabWidth, "", obj)
+	}
+
+	src := types.ObjectString(tobj, nil)
+	d := &Doc{
+		Src:  src,
+		Name: tobj.Name(),
+		Kind: typeObjKind(tobj),
+		Decl: src,
+	}
+	if tobj.Pkg() != nil {
+		d.Pkg = tobj.Pkg().Name()
+	}
+	if tobj.Pos().IsValid() {
+		tp := fset.Position(tobj.Pos())
+		d.Fn = tp.Filename
+		d.Row = tp.Line - 1
+		d.Col = tp.Column - 1
+	}
+	return d
+}
+
+// fieldSrc returns the source of a struct field, interface method or parameter along with its doc comment.
+// The printer doesn't handle fields on their own
+func fieldSrc(fset *token.FileSet, f *ast.Field, tabIndent bool, tabWidth int) string {
+	typ, _ := printSrc(fset, f.Type, tabIndent, tabWidth)
+	if _, ok := f.Type.(*ast.FuncType); ok && len(f.Names) != 0 {
+		// interface methods are declared without the func keyword
+		typ = strings.TrimPrefix(typ, "func")
+	} else if len(f.Names) != 0 {
+		typ = " " + typ
+	}
+
+	names := []string{}
+	for _, id := range f.Names {
+		names = append(names, id.Name)
+	}
+	src := strings.Join(names, ", ") + typ
+
+	if f.Doc != nil {
+		doc := []string{}
+		for _, c := range f.Doc.List {
+			doc = append(doc, c.Text)
+		}
+		src = strings.Join(doc, "\n") + "\n" + src
+	}
+	if f.Comment != nil {
+		src += " " + f.Comment.List[0].Text
+	}
+	return src
+}
+
+// dotImportPkgs returns the packages imported by af using `import . "path"`
+func dotImportPkgs(fset *token.FileSet, af *ast.File, srcRootDirs []string, mode parser.Mode) []*ast.Package {
+	l := []*ast.Package{}
+	for _, ispec := range af.Imports {
+		if ispec.Name == nil || ispec.Name.Name != "." {
+			continue
+		}
+		if pkg, _, _ := findPkg(fset, unquote(ispec.Path.Value), srcRootDirs, mode); pkg != nil {
+			l = append(l, pkg)
+		}
+	}
+	return l
 }
 
 func isBetween(n, start, end int) bool {
@@ -189,7 +444,14 @@ func findUnderlyingObj(fset *token.FileSet, af *ast.File, pkg *ast.Package, pkgs
 		if obj := pkg.Scope.Lookup(id.Name); obj != nil {
 			return obj, pkg, pkgs
 		}
-		fn := filepath.Join(runtime.GOROOT(), "src", "pkg", "builtin")
+		if ast.IsExported(id.Name) {
+			for _, dotPkg := range dotImportPkgs(fset, af, srcRootDirs, parser.ParseComments) {
+				if obj := dotPkg.Scope.Lookup(id.Name); obj != nil {
+					return obj, dotPkg, map[string]*ast.Package{dotPkg.Name: dotPkg}
+				}
+			}
+		}
+		fn := filepath.Join(gorootSrc(runtime.GOROOT()), "builtin")
 		if pkgBuiltin, _, err := parsePkg(fset, fn, parser.ParseComments); err == nil {
 			if obj := pkgBuiltin.Scope.Lookup(id.Name); obj != nil {
 				return obj, pkgBuiltin, pkgs
@@ -203,82 +465,79 @@ func findUnderlyingObj(fset *token.FileSet, af *ast.File, pkg *ast.Package, pkgs
 
 	switch x := sel.X.(type) {
 	case *ast.Ident:
-		if x.Obj != nil {
-			// todo: resolve type
-		} else {
-			if v := pkg.Scope.Lookup(id.Name); v != nil {
-				// todo: found a type?
+		if x.Obj != nil || pkg.Scope.Lookup(x.Name) != nil {
+			// x is a value or type, not a package, so the selector can only be resolved by findTypedObj
+			// which /doc tries before falling back to this
+			return nil, pkg, pkgs
+		}
+
+		// it's most likely a package
+		for _, ispec := range af.Imports {
+			importPath := unquote(ispec.Path.Value)
+			pkgAlias := ""
+			if ispec.Name == nil {
+				_, pkgAlias = path.Split(importPath)
 			} else {
-				// it's most likely a package
-				// todo: handle .dot imports
-				for _, ispec := range af.Imports {
-					importPath := unquote(ispec.Path.Value)
-					pkgAlias := ""
-					if ispec.Name == nil {
-						_, pkgAlias = path.Split(importPath)
-					} else {
-						pkgAlias = ispec.Name.Name
-					}
-					if pkgAlias == x.Name {
-						if id == x {
-							// where do we go as the first place of a package?
-							pkg, pkgs, _ = findPkg(fset, importPath, srcRootDirs, parser.ParseComments|parser.PackageClauseOnly)
-							if pkg != nil {
-								// we'll just match the behaviour of package browsing
-								// we will visit some file within the package
-								// but which file, or where is undefined
-								var f *ast.File
-								ok := false
-								if len(pkg.Files) > 0 {
-									basedir := ""
-									for fn, _ := range pkg.Files {
-										basedir = filepath.Dir(fn)
-										break
-									}
-									baseFn := func(fn string) string {
-										return filepath.Join(basedir, fn)
-									}
-									if f, ok = pkg.Files[baseFn("doc.go")]; !ok {
-										if f, ok = pkg.Files[baseFn("main.go")]; !ok {
-											if f, ok = pkg.Files[baseFn(pkgAlias+".go")]; !ok {
-												// try to keep things consistent
-												filenames := sort.StringSlice{}
-												for filename, _ := range pkg.Files {
-													filenames = append(filenames, filename)
-												}
-												sort.Sort(filenames)
-												f = pkg.Files[filenames[0]]
-											}
+				pkgAlias = ispec.Name.Name
+			}
+			if pkgAlias == x.Name {
+				if id == x {
+					// where do we go as the first place of a package?
+					pkg, pkgs, _ = findPkg(fset, importPath, srcRootDirs, parser.ParseComments|parser.PackageClauseOnly)
+					if pkg != nil {
+						// we'll just match the behaviour of package browsing
+						// we will visit some file within the package
+						// but which file, or where is undefined
+						var f *ast.File
+						ok := false
+						if len(pkg.Files) > 0 {
+							basedir := ""
+							for fn, _ := range pkg.Files {
+								basedir = filepath.Dir(fn)
+								break
+							}
+							baseFn := func(fn string) string {
+								return filepath.Join(basedir, fn)
+							}
+							if f, ok = pkg.Files[baseFn("doc.go")]; !ok {
+								if f, ok = pkg.Files[baseFn("main.go")]; !ok {
+									if f, ok = pkg.Files[baseFn(pkgAlias+".go")]; !ok {
+										// try to keep things consistent
+										filenames := sort.StringSlice{}
+										for filename, _ := range pkg.Files {
+											filenames = append(filenames, filename)
 										}
+										sort.Sort(filenames)
+										f = pkg.Files[filenames[0]]
 									}
 								}
-
-								if f != nil && f.Name != nil {
-									doc := f.Doc
-									if len(f.Comments) > 0 && f.Doc == nil {
-										doc = f.Comments[len(f.Comments)-1]
-									}
-									o := &ast.Object{
-										Kind: ast.Pkg,
-										Name: f.Name.Name,
-										Decl: &ast.TypeSpec{
-											Name: f.Name,
-											Doc:  doc,
-											Type: f.Name,
-										},
-									}
-									return o, pkg, pkgs
-								}
 							}
-							// in-case we don't find a pkg decl
-							return nil, pkg, pkgs
 						}
 
-						if pkg, pkgs, _ = findPkg(fset, importPath, srcRootDirs, parser.ParseComments); pkg != nil {
-							obj := pkg.Scope.Lookup(id.Name)
-							return obj, pkg, pkgs
+						if f != nil && f.Name != nil {
+							doc := f.Doc
+							if len(f.Comments) > 0 && f.Doc == nil {
+								doc = f.Comments[len(f.Comments)-1]
+							}
+							o := &ast.Object{
+								Kind: ast.Pkg,
+								Name: f.Name.Name,
+								Decl: &ast.TypeSpec{
+									Name: f.Name,
+									Doc:  doc,
+									Type: f.Name,
+								},
+							}
+							return o, pkg, pkgs
 						}
 					}
+					// in-case we don't find a pkg decl
+					return nil, pkg, pkgs
+				}
+
+				if pkg, pkgs, _ = findPkg(fset, importPath, srcRootDirs, parser.ParseComments); pkg != nil {
+					obj := pkg.Scope.Lookup(id.Name)
+					return obj, pkg, pkgs
 				}
 			}
 		}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type ExamplesArgs struct {
+	Path      string            `json:"path"`
+	Fn        string            `json:"fn"`
+	Env       map[string]string `json:"env"`
+	Run       bool              `json:"run"`
+	Name      string            `json:"name"`
+	Timeout   int               `json:"timeout"`
+	TabIndent bool              `json:"tab_indent"`
+	TabWidth  int               `json:"tab_width"`
+}
+
+type ExamplesResult struct {
+	ImportPath string         `json:"import_path"`
+	Dir        string         `json:"dir"`
+	Examples   []*ExampleInfo `json:"examples"`
+	Run        *ExampleRun    `json:"run,omitempty"`
+}
+
+// ExampleInfo is an example function in the file Fn. Func is the name of the function and Pkg is the name of
+// the package it's declared in. Play is the example as a standalone main program. It's only set for examples
+// in the external test package (e.g. package x_test) that can be written as one
+type ExampleInfo struct {
+	*PkgDocExample
+	Func string `json:"func"`
+	Pkg  string `json:"pkg"`
+	Fn   string `json:"fn"`
+	Row  int    `json:"row"`
+	Col  int    `json:"col"`
+	Play string `json:"play"`
+}
+
+// ExampleRun is the result of running an example. Checked is true if the example has an output comment,
+// in which case Matched reports whether Output, the actual output, matched Want.
+// Err is set if the example couldn't be built, it panicked or it timed out
+type ExampleRun struct {
+	Name     string `json:"name"`
+	Output   string `json:"output"`
+	Want     string `json:"want"`
+	Checked  bool   `json:"checked"`
+	Matched  bool   `json:"matched"`
+	TimedOut bool   `json:"timed_out"`
+	Err      string `json:"err"`
+}
+
+const (
+	// the name of the file that's added to the package to run an example, it never exists on disk
+	exampleRunFn = "margo_example_run_test.go"
+	// the markers printed before and after the example's output
+	exampleRunStart = "\n--- margo example start ---\n"
+	exampleRunEnd   = "\n--- margo example end ---\n"
+	// building the test binary is not included in the timeout, but it's still limited
+	exampleBuildTimeout = 2 * time.Minute
+	// how long an example may run for if no timeout, or one that's <= 0, is given
+	exampleRunTimeout = 10 * time.Second
+)
+
+func init() {
+	act(Action{
+		Path: "/examples",
+		Doc: `
+lists the examples in the package with import path (or in the dir) path and optionally runs one of them
+@data: {"path": "...", "fn": "", "env": {}, "run": false, "name": "", "timeout": 10, "tab_indent": true, "tab_width": 8}
+@resp: {"import_path": "", "dir": "", "examples": [], "run": {"name": "", "output": "", "want": "", "checked": false, "matched": false, "timed_out": false, "err": ""}}
+import paths are resolved relative to the dir of the file fn, if set.
+examples are: {"name": "", "suffix": "", "doc": "", "code": "", "output": "", "unordered": false, "empty_output": false, "func": "", "pkg": "", "fn": "", "row": 0, "col": 0, "play": ""}
+where output is the expected output from the example's output comment and play is the example rewritten as a standalone main program.
+play is only set for examples in the external test package (e.g. package x_test) that can be written as a standalone program,
+it's always empty for examples declared in the package under test.
+if run is true, the example with the name (e.g. "Thing_Do" for ExampleThing_Do, or "" for Example) is built along with the package's tests,
+in a temporary dir, and run for at most timeout seconds (10 if it's 0 or less). checked is true if the example has an output comment,
+in which case matched reports whether the actual output matched it. examples without an output comment are run as well
+`,
+		Func: func(r Request) (data, error) {
+			a := ExamplesArgs{
+				Env:     map[string]string{},
+				Timeout: int(exampleRunTimeout / time.Second),
+			}
+			res := &ExamplesResult{
+				Examples: []*ExampleInfo{},
+			}
+			if err := r.Decode(&a); err != nil {
+				return res, err
+			}
+
+			srcDir := ""
+			if a.Fn != "" {
+				fn, _ := filepath.Abs(a.Fn)
+				srcDir = filepath.Dir(fn)
+			}
+			dir, err := pkgDocDir(a.Env, a.Path, srcDir)
+			if err != nil {
+				return res, err
+			}
+			res.Dir = dir
+			res.ImportPath = dirImportPath(buildContext(a.Env, nil), dir)
+			res.Examples, err = pkgExamples(a.Env, dir, a.TabIndent, a.TabWidth)
+			if err != nil || !a.Run {
+				return res, err
+			}
+
+			var ex *ExampleInfo
+			for _, v := range res.Examples {
+				if v.Name == a.Name {
+					ex = v
+					break
+				}
+			}
+			if ex == nil {
+				return res, errors.New("unknown example: Example" + a.Name)
+			}
+			timeout := time.Duration(a.Timeout) * time.Second
+			if timeout <= 0 {
+				timeout = exampleRunTimeout
+			}
+			res.Run = runExample(a.Env, dir, ex, timeout)
+			return res, nil
+		},
+	})
+}
+
+// pkgExamples returns the examples in the test files of the package in dir, in the order they're declared
+func pkgExamples(env map[string]string, dir string, tabIndent bool, tabWidth int) ([]*ExampleInfo, error) {
+	l := []*ExampleInfo{}
+	ctx := buildContext(env, nil)
+	bp, err := ctx.ImportDir(dir, 0)
+	if bp == nil || bp.Name == "" {
+		if err == nil {
+			err = fmt.Errorf("no buildable Go source files in %s", dir)
+		}
+		return l, err
+	}
+
+	fset := token.NewFileSet()
+	for _, names := range [][]string{bp.TestGoFiles, bp.XTestGoFiles} {
+		for _, name := range names {
+			fn := filepath.Join(dir, name)
+			af, _ := parser.ParseFile(fset, fn, nil, parser.ParseComments)
+			if af == nil {
+				continue
+			}
+
+			decls := map[string]*ast.FuncDecl{}
+			for _, d := range af.Decls {
+				if fd, ok := d.(*ast.FuncDecl); ok && fd.Recv == nil {
+					decls[fd.Name.Name] = fd
+				}
+			}
+			exl := doc.Examples(af)
+			sort.Sort(exampleList(exl))
+			for _, ex := range exl {
+				ei := &ExampleInfo{
+					PkgDocExample: pkgDocExamples(fset, []*doc.Example{ex}, tabIndent, tabWidth)[0],
+					Func:          "Example" + ex.Name,
+					Pkg:           af.Name.Name,
+					Fn:            fn,
+				}
+				// doc.Examples only sets the suffix when the examples are associated with a package
+				_, ei.Suffix = splitExampleName(ex.Name)
+				if fd := decls[ei.Func]; fd != nil {
+					tp := fset.Position(fd.Pos())
+					ei.Row = tp.Line - 1
+					ei.Col = tp.Column - 1
+				}
+				if ex.Play != nil {
+					ei.Play, _ = printSrc(fset, ex.Play, tabIndent, tabWidth)
+				}
+				l = append(l, ei)
+			}
+		}
+	}
+	return l, nil
+}
+
+// splitExampleName splits the name of an example e.g. Thing_Do_second into the name of what it's for and its suffix.
+// Suffixes start with a lower-case letter
+func splitExampleName(s string) (name, suffix string) {
+	i := strings.LastIndex(s, "_")
+	if i >= 0 && i < len(s)-1 {
+		if r, _ := utf8.DecodeRuneInString(s[i+1:]); !unicode.IsUpper(r) {
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+// runExample builds the tests of the package in dir with a test that calls the example ex and runs it for at most timeout.
+// The test is added to the package using an overlay, so nothing is written to dir
+func runExample(env map[string]string, dir string, ex *ExampleInfo, timeout time.Duration) *ExampleRun {
+	run := &ExampleRun{
+		Name:    ex.Name,
+		Want:    ex.Output,
+		Checked: ex.Output != "" || ex.EmptyOutput,
+	}
+
+	tmpDir, err := ioutil.TempDir("", "margo-example-")
+	if err != nil {
+		run.Err = err.Error()
+		return run
+	}
+	defer os.RemoveAll(tmpDir)
+
+	src := fmt.Sprintf(`package %s
+
+import (
+	margo_os "os"
+	margo_testing "testing"
+)
+
+func TestMargoRunExample(t *margo_testing.T) {
+	margo_os.Stdout.WriteString(%q)
+	%s()
+	margo_os.Stdout.WriteString(%q)
+}
+`, ex.Pkg, exampleRunStart, ex.Func, exampleRunEnd)
+	testFn := filepath.Join(tmpDir, exampleRunFn)
+	overlayFn := filepath.Join(tmpDir, "overlay.json")
+	overlay, _ := json.Marshal(map[string]map[string]string{
+		"Replace": {filepath.Join(dir, exampleRunFn): testFn},
+	})
+	if err := ioutil.WriteFile(testFn, []byte(src), 0644); err != nil {
+		run.Err = err.Error()
+		return run
+	}
+	if err := ioutil.WriteFile(overlayFn, overlay, 0644); err != nil {
+		run.Err = err.Error()
+		return run
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exampleBuildTimeout)
+	defer cancel()
+	bin := filepath.Join(tmpDir, "example.test")
+	cmd := exec.CommandContext(ctx, goCmd(env), "test", "-c", "-o", bin, "-overlay", overlayFn, ".")
+	cmd.Dir = dir
+	cmd.Env = goCmdEnv(env, dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		run.Err = strings.TrimSpace(string(out))
+		if run.Err == "" {
+			run.Err = err.Error()
+		}
+		return run
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd = exec.CommandContext(ctx, bin, "-test.run", "^TestMargoRunExample$")
+	// examples are run in the package dir, like go test does
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+
+	out := stdout.String()
+	if i := strings.Index(out, exampleRunStart); i >= 0 {
+		out = out[i+len(exampleRunStart):]
+	}
+	if i := strings.LastIndex(out, exampleRunEnd); i >= 0 {
+		out = out[:i]
+	} else {
+		// the example panicked or exited, in which case the test fails
+		if i := strings.LastIndex(out, "--- FAIL: TestMargoRunExample"); i >= 0 {
+			out = out[:i]
+		}
+		if err == nil {
+			err = errors.New("the example exited before it returned")
+		}
+	}
+	run.Output = out
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		run.TimedOut = true
+		run.Err = fmt.Sprintf("timed out after %s", timeout)
+	case err != nil:
+		run.Err = strings.TrimSpace(stderr.String())
+		if run.Err == "" {
+			run.Err = err.Error()
+		}
+	}
+	if run.Checked && run.Err == "" {
+		run.Matched = exampleOutputMatches(run.Output, run.Want, ex.Unordered)
+	}
+	return run
+}
+
+// exampleOutputMatches reports whether got matches the output comment want, the same way go test compares them
+func exampleOutputMatches(got, want string, unordered bool) bool {
+	norm := func(s string) string {
+		s = strings.TrimSpace(strings.Replace(s, "\r\n", "\n", -1))
+		if unordered {
+			l := strings.Split(s, "\n")
+			sort.Strings(l)
+			s = strings.Join(l, "\n")
+		}
+		return s
+	}
+	return norm(got) == norm(want)
+}
+
+// goCmd returns the path of the go command in GOROOT, falling back to the one in PATH
+func goCmd(env map[string]string) string {
+	fn := filepath.Join(envGoroot(env), "bin", "go")
+	if _, err := os.Stat(fn); err == nil {
+		return fn
+	}
+	return "go"
+}
+
+// goCmdEnv returns the environment the go command is run with in dir. GOROOT and GOPATH are taken from env.
+// Outside of a module, GOPATH mode is used
+func goCmdEnv(env map[string]string, dir string) []string {
+	l := os.Environ()
+	for _, k := range []string{"GOROOT", "GOPATH"} {
+		if v := env[k]; v != "" {
+			l = append(l, k+"="+v)
+		}
+	}
+	if modRoot, _ := findModule(dir); modRoot == "" {
+		l = append(l, "GO111MODULE=off")
+	}
+	return l
+}
+
+// exampleList sorts examples in the order they're declared
+type exampleList []*doc.Example
+
+func (l exampleList) Len() int {
+	return len(l)
+}
+
+func (l exampleList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l exampleList) Less(i, j int) bool {
+	return l[i].Order < l[j].Order
+}
@@ -6,10 +6,24 @@ import (
 )
 
 type AcFmtArgs struct {
-	Fn        string `json:"fn"`
-	Src       string `json:"src"`
-	TabIndent bool   `json:"tab_indent"`
-	TabWidth  int    `json:"tab_width"`
+	Fn           string            `json:"fn"`
+	Src          string            `json:"src"`
+	TabIndent    bool              `json:"tab_indent"`
+	TabWidth     int               `json:"tab_width"`
+	Edits        bool              `json:"edits"`
+	Simplify     bool              `json:"simplify"`
+	Rewrite      []string          `json:"rewrite"`
+	Offsets      []int             `json:"offsets"`
+	FixImports   bool              `json:"fix_imports"`
+	Env          map[string]string `json:"env"`
+	ImportGroups []ImportGroup     `json:"import_groups"`
+}
+
+type AcFmtResult struct {
+	Src     string          `json:"src"`
+	Edits   []*TextEdit     `json:"edits"`
+	Offsets []int           `json:"offsets"`
+	Imports []ImportDeclArg `json:"imports"`
 }
 
 func init() {
@@ -17,24 +31,81 @@ func init() {
 		Path: "/fmt",
 		Doc: `
 formats the source like gofmt does
-@data: {"fn": "...", "src": "..."}
+@data: {"fn": "...", "src": "...", "edits": false, "simplify": false, "rewrite": ["pattern -> replacement"], "offsets": [0], "fix_imports": false, "env": {}, "import_groups": []}
 @resp: "formatted source"
+if simplify is true, the source is simplified like gofmt -s does
+each rewrite rule is applied in order like gofmt -r does
+if edits is true, the response is instead {"src": "formatted source", "edits": [{"start": 0, "end": 0, "text": "..."}]}
+where edits is the list of changes needed to transform the original source into the formatted source
+if offsets (e.g. the cursor and selections) are set, the response is also an object
+and offsets contains the position of each offset in the formatted source
+if fix_imports is true, missing imports are added and unused imports are removed like goimports does.
+the response is an object and imports contains the list of imports that were added or removed
+if import_groups (e.g. [{"name": "stdlib"}, {"name": "external"}, {"name": "local", "prefixes": ["github.com/me/"]}]) is set,
+the imports are merged into a single block and split into those groups
 `,
 		Func: func(r Request) (data, error) {
 			a := AcFmtArgs{
 				TabIndent: true,
 				TabWidth:  8,
+				Env:       map[string]string{},
 			}
 
-			res := ""
+			res := AcFmtResult{}
 			if err := r.Decode(&a); err != nil {
-				return res, err
+				return res.Src, err
+			}
+
+			src, err := readSrc(a.Fn, a.Src)
+			if err != nil {
+				return res.Src, err
 			}
 
-			fset, af, err := parseAstFile(a.Fn, a.Src, parser.ParseComments)
+			type rule struct{ pattern, replace ast.Expr }
+			rules := []rule{}
+			for _, s := range a.Rewrite {
+				pattern, replace, err := parseRewriteRule(s)
+				if err != nil {
+					return res.Src, err
+				}
+				rules = append(rules, rule{pattern, replace})
+			}
+
+			// fixing imports may add or remove imports in the block containing `import "C"`
+			// so it's split out first to keep its cgo preamble attached to it
+			fmtSrc := src
+			if a.FixImports {
+				fmtSrc = splitImportC(src)
+			}
+			fset, af, err := parseAstFile(a.Fn, fmtSrc, parser.ParseComments)
+			if err == nil {
+				for _, r := range rules {
+					af = rewriteFile(fset, r.pattern, r.replace, af)
+				}
+				if a.Simplify {
+					simplify(af)
+				}
+				if a.FixImports {
+					res.Imports = fixImports(fset, a.Fn, af, a.Env)
+					fset, af, err = imp(fset, af, res.Imports)
+				}
+			}
 			if err == nil {
 				ast.SortImports(fset, af)
-				res, err = printSrc(fset, af, a.TabIndent, a.TabWidth)
+				res.Src, err = printSrc(fset, af, a.TabIndent, a.TabWidth)
+				if err == nil {
+					res.Src, err = groupImports(res.Src, a.ImportGroups, a.TabIndent, a.TabWidth)
+				}
+			}
+
+			if !a.Edits && a.Offsets == nil && !a.FixImports {
+				return res.Src, err
+			}
+			if err == nil {
+				if a.Edits {
+					res.Edits = textEdits(src, res.Src)
+				}
+				res.Offsets = mapOffsets(src, res.Src, a.Offsets)
 			}
 			return res, err
 		},
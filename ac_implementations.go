@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/types"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+type ImplementationsArgs struct {
+	Fn        string            `json:"fn"`
+	Src       string            `json:"src"`
+	Offset    int               `json:"offset"`
+	Env       map[string]string `json:"env"`
+	Scope     string            `json:"scope"`
+	Dirs      []string          `json:"dirs"`
+	TabIndent bool              `json:"tab_indent"`
+	TabWidth  int               `json:"tab_width"`
+}
+
+// ImplementationsResult lists the types that implement an interface (Kind is interface)
+// or the interfaces that a type implements (Kind is type)
+type ImplementationsResult struct {
+	Name  string  `json:"name"`
+	Kind  string  `json:"kind"`
+	Pkg   string  `json:"pkg"`
+	Impls []*Impl `json:"impls"`
+}
+
+// Impl is a type that implements the interface, or an interface implemented by the type.
+// Ptr is true if only the pointer to the type implements the interface
+type Impl struct {
+	*Doc
+	Ptr bool `json:"ptr"`
+}
+
+var (
+	// the packages whose interfaces are always checked when looking for the interfaces a type implements
+	wellKnownIfacePkgs = []string{
+		"container/heap",
+		"context",
+		"database/sql",
+		"database/sql/driver",
+		"encoding",
+		"encoding/json",
+		"encoding/xml",
+		"flag",
+		"fmt",
+		"hash",
+		"io",
+		"net/http",
+		"sort",
+	}
+)
+
+func init() {
+	act(Action{
+		Path: "/implementations",
+		Doc: `
+finds the types that implement the interface, or the interfaces implemented by the type, at offset in the file fn (whose content is src, if set)
+@data: {"fn": "...", "src": "...", "offset": 0, "env": {}, "scope": "package", "dirs": [], "tab_indent": true, "tab_width": 8}
+@resp: {"name": "", "kind": "", "pkg": "", "impls": [{"src": "...", "pkg": "", "name": "", "kind": "", "fn": "", "row": 0, "col": 0, "decl": "", "comment": "", "rendered": "", "ptr": false}]}
+kind is interface if the identifier names an interface, and type otherwise.
+the identifier may also name a variable, constant or field, in which case its type is used.
+impls are in the same shape as the results of /doc, ptr is true if only the pointer to the type implements the interface.
+scope is one of:
+	package: the package containing fn, including its tests, and the package declaring the identifier (the default)
+	importers: the package, the package declaring the identifier, all the packages in GOROOT and GOPATH that import it and all the packages in the enclosing module
+	dirs: the package, the package declaring the identifier and the packages in the list of dirs
+the interfaces implemented by a type are also looked for in the packages imported by fn's package, the builtin error
+and the interfaces of well-known packages in the standard library e.g. io.Reader and fmt.Stringer
+`,
+		Func: func(r Request) (data, error) {
+			a := ImplementationsArgs{
+				Env:   map[string]string{},
+				Scope: "package",
+			}
+			if err := r.Decode(&a); err != nil {
+				return newImplementationsResult(), err
+			}
+			return findImplementations(a)
+		},
+	})
+}
+
+func newImplementationsResult() *ImplementationsResult {
+	return &ImplementationsResult{
+		Impls: []*Impl{},
+	}
+}
+
+func findImplementations(a ImplementationsArgs) (*ImplementationsResult, error) {
+	res := newImplementationsResult()
+	if a.Fn == "" {
+		return res, errors.New("fn must be set")
+	}
+	fn, _ := filepath.Abs(a.Fn)
+
+	tc, err := typeCheck(a.Env, fn, a.Src, nil)
+	if err != nil {
+		return res, err
+	}
+
+	typeCheckLck.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			typeCheckLck.Unlock()
+		}
+	}()
+
+	tobj := typeObjAt(tc, a.Offset)
+	if tobj == nil {
+		return res, errors.New("no identifier at offset")
+	}
+	var typ types.Type
+	switch tobj.(type) {
+	case *types.TypeName, *types.Var, *types.Const:
+		typ = tobj.Type()
+		if p, ok := typ.(*types.Pointer); ok {
+			typ = p.Elem()
+		}
+	default:
+		return res, fmt.Errorf("%s is a %s, not a type", tobj.Name(), typeObjKind(tobj))
+	}
+	iface, isIface := typ.Underlying().(*types.Interface)
+	if isIface && (!iface.IsMethodSet() || iface.NumMethods() == 0) {
+		return res, fmt.Errorf("%s is an empty interface or a type constraint", tobj.Name())
+	}
+
+	res.Name = types.TypeString(typ, types.RelativeTo(tc.Pkg))
+	res.Kind = "type"
+	if isIface {
+		res.Kind = "interface"
+	}
+	var tn *types.TypeName
+	declDir := ""
+	pkgLevel := false
+	if named, ok := typ.(*types.Named); ok {
+		tn = named.Obj()
+		res.Name = tn.Name()
+		if tn.Pkg() != nil {
+			res.Pkg = tn.Pkg().Path()
+			pkgLevel = tn.Parent() == tn.Pkg().Scope()
+			if tn.Pos().IsValid() {
+				declDir = filepath.Dir(tc.Fset.Position(tn.Pos()).Filename)
+			}
+		}
+	}
+
+	keys := map[string]bool{}
+	if tn != nil {
+		keys[typeObjKey(tc.Fset, tn)] = true
+	}
+	add := func(obj *types.TypeName, ptr bool) {
+		k := typeObjKey(tc.Fset, obj)
+		if k == "" {
+			k = obj.Name()
+		}
+		if keys[k] {
+			return
+		}
+		keys[k] = true
+		res.Impls = append(res.Impls, &Impl{
+			Doc: typeObjDoc(tc.Fset, obj, a.TabIndent, a.TabWidth),
+			Ptr: ptr,
+		})
+	}
+	check := func(typ types.Type, candidates []*types.TypeName) {
+		for _, obj := range candidates {
+			// the unexported interfaces of other packages can't be referred to
+			if !isIface && obj.Pkg() != nil && obj.Pkg() != tc.Pkg && !obj.Exported() {
+				continue
+			}
+			if ptr, ok := typeImplements(typ, obj.Type(), isIface); ok {
+				add(obj, ptr)
+			}
+		}
+	}
+
+	// fn's package, including the types declared in functions, and for types, the packages it imports.
+	// they're checked before the lock is released to load the other packages, while tc's objects are
+	// guaranteed to be in the current FileSet
+	local := []*types.TypeName{}
+	for _, obj := range tc.Info.Defs {
+		if obj, ok := obj.(*types.TypeName); ok {
+			local = append(local, obj)
+		}
+	}
+	if !isIface {
+		for _, pkg := range tc.Pkg.Imports() {
+			local = append(local, pkgTypeNames(pkg)...)
+		}
+	}
+	check(typ, local)
+	typeCheckLck.Unlock()
+	locked = false
+
+	// the other packages are checked as dependencies, so they're compared with typ as it's seen by its importers
+	dirs := []string{}
+	if pkgLevel && tn.Exported() {
+		switch a.Scope {
+		case "package", "":
+			dirs = append(dirs, declDir)
+		case "importers":
+			dirs = append(dirs, declDir)
+			dirs = append(dirs, importerDirs(a.Env, fn, res.Pkg)...)
+			if modRoot, _ := findModule(filepath.Dir(fn)); modRoot != "" {
+				for _, pkgFn := range walkRootDir(modRoot, defaultWalkOptions()) {
+					dirs = append(dirs, filepath.Dir(pkgFn))
+				}
+			}
+		case "dirs":
+			dirs = append(dirs, declDir)
+			for _, dir := range a.Dirs {
+				if dir, err := filepath.Abs(dir); err == nil {
+					dirs = append(dirs, dir)
+				}
+			}
+		default:
+			return res, errors.New("unknown scope: " + a.Scope)
+		}
+	}
+
+	pkgs := []*types.Package{}
+	seen := map[string]bool{filepath.Dir(fn): true}
+	ctx := buildContext(a.Env, nil)
+	for _, dir := range dirs {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if p := dirImportPath(ctx, dir); p != "" {
+			if pkg, _ := typeCheckImport(a.Env, p, dir); pkg != nil {
+				pkgs = append(pkgs, pkg)
+			}
+		}
+	}
+
+	// typ as seen by the other packages
+	var depTyp types.Type
+	if pkgLevel && declDir != "" {
+		if pkg, _ := typeCheckImport(a.Env, tn.Pkg().Path(), declDir); pkg != nil {
+			if obj, ok := pkg.Scope().Lookup(tn.Name()).(*types.TypeName); ok {
+				depTyp = obj.Type()
+			}
+		}
+	}
+
+	depIfaces := []*types.TypeName{}
+	if !isIface {
+		if obj, ok := types.Universe.Lookup("error").(*types.TypeName); ok {
+			depIfaces = append(depIfaces, obj)
+		}
+		for _, p := range wellKnownIfacePkgs {
+			if pkg, _ := typeCheckImport(a.Env, p, filepath.Dir(fn)); pkg != nil {
+				depIfaces = append(depIfaces, pkgTypeNames(pkg)...)
+			}
+		}
+	}
+
+	typeCheckLck.Lock()
+	locked = true
+
+	// the positions of the other packages are only meaningful in tc.Fset if the cache wasn't evicted in the meantime
+	if typeCheckFset != tc.Fset {
+		return res, errors.New("the type-check cache was reset, please try again")
+	}
+
+	if depTyp != nil {
+		for _, pkg := range pkgs {
+			check(depTyp, pkgTypeNames(pkg))
+		}
+	}
+	// the well-known interfaces don't refer to fn's package, so they may be compared with either
+	check(typ, depIfaces)
+
+	sort.Sort(implList(res.Impls))
+	return res, nil
+}
+
+// typeImplements reports whether the type of the candidate cand implements the interface typ (if isIface)
+// or, the interface cand is implemented by typ. ptr is true if only the pointer type implements the interface
+func typeImplements(typ, cand types.Type, isIface bool) (ptr, ok bool) {
+	t, iface := cand, typ
+	if !isIface {
+		t, iface = typ, cand
+	}
+	if _, ok := cand.(*types.Named); !ok {
+		return false, false
+	}
+	for _, t := range []types.Type{typ, cand} {
+		// the behaviour of types.Implements is unspecified for uninstantiated generic types
+		if named, ok := t.(*types.Named); ok && named.TypeParams().Len() != 0 {
+			return false, false
+		}
+	}
+	it, ok := iface.Underlying().(*types.Interface)
+	if !ok || !it.IsMethodSet() || it.NumMethods() == 0 {
+		return false, false
+	}
+	if types.IsInterface(t) {
+		// interfaces that embed, or are a superset of, an interface aren't implementations of it
+		return false, false
+	}
+	if types.Implements(t, it) {
+		return false, true
+	}
+	if types.Implements(types.NewPointer(t), it) {
+		return true, true
+	}
+	return false, false
+}
+
+// pkgTypeNames returns the types declared at the package level of pkg
+func pkgTypeNames(pkg *types.Package) []*types.TypeName {
+	l := []*types.TypeName{}
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		if obj, ok := scope.Lookup(name).(*types.TypeName); ok && !obj.IsAlias() {
+			l = append(l, obj)
+		}
+	}
+	return l
+}
+
+type implList []*Impl
+
+func (l implList) Len() int {
+	return len(l)
+}
+
+func (l implList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l implList) Less(i, j int) bool {
+	a, b := l[i], l[j]
+	if a.Fn != b.Fn {
+		// types declared in the same dir are listed together
+		if da, db := path.Dir(filepath.ToSlash(a.Fn)), path.Dir(filepath.ToSlash(b.Fn)); da != db {
+			return da < db
+		}
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.Fn < b.Fn
+}
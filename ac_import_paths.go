@@ -2,44 +2,124 @@ package main
 
 import (
 	"go/ast"
+	"go/build"
+	"go/doc"
 	"go/parser"
+	"go/token"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
+var (
+	pkgNamesLck      = sync.Mutex{}
+	pkgNamesCache    = map[string]pkgNameEnt{}
+	pkgSynopsesLck   = sync.Mutex{}
+	pkgSynopsesCache = map[string]pkgSynopsisEnt{}
+	modPathRe        = regexp.MustCompile(`(?m)^module\s+"?([^"\s]+)"?\s*$`)
+)
+
+type pkgNameEnt struct {
+	modTime time.Time
+	name    string
+}
+
+type pkgSynopsisEnt struct {
+	modTime  time.Time
+	synopsis string
+}
+
 type ImportPathsArgs struct {
-	Fn  string            `json:"fn"`
-	Src string            `json:"src"`
-	Env map[string]string `json:"env"`
+	Fn       string            `json:"fn"`
+	Src      string            `json:"src"`
+	Env      map[string]string `json:"env"`
+	Query    string            `json:"query"`
+	Limit    int               `json:"limit"`
+	Synopsis bool              `json:"synopsis"`
 }
 
 type ImportPathsResult struct {
-	Paths   []string     `json:"paths"`
-	Imports []ImportDecl `json:"imports"`
+	Paths   []string           `json:"paths"`
+	Pkgs    []*ImportPathInfo  `json:"pkgs"`
+	Matches []*ImportPathMatch `json:"matches"`
+	Imports []ImportDecl       `json:"imports"`
+}
+
+// ImportPathMatch is a package matched by the query passed to /import_paths.
+// Ranges are the byte ranges [start, end) of Path that matched the query
+type ImportPathMatch struct {
+	*ImportPathInfo
+	Score  int      `json:"score"`
+	Ranges [][2]int `json:"ranges"`
+
+	usage  int
+	global int
+}
+
+// ImportPathInfo describes a package that may be imported.
+// Kind is one of `stdlib`, `gopath`, `vendor` or `module`
+type ImportPathInfo struct {
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Dir      string `json:"dir"`
+	Synopsis string `json:"synopsis,omitempty"`
 }
 
 func init() {
 	act(Action{
 		Path: "/import_paths",
-		Doc:  "",
+		Doc: `
+lists the packages that may be imported by the file fn, and the packages it currently imports
+@data: {"fn": "...", "src": "...", "env": {}, "query": "", "limit": 50, "synopsis": false}
+@resp: {"paths": ["..."], "pkgs": [{"path": "encoding/json", "name": "json", "kind": "stdlib", "dir": "...", "synopsis": "..."}], "matches": [], "imports": [{"name": "", "path": "..."}]}
+if query is set, only the packages whose import path or name fuzzily match it are returned in paths and pkgs,
+at most limit of them (default 50), best first: stdlib packages, then packages imported elsewhere in the project,
+then packages imported most often across GOROOT and GOPATH (see /import_usage), then shorter paths.
+matches contains the same packages with their score and the byte ranges of the path that matched, for highlighting.
+if synopsis is true, each package includes the first sentence of its documentation
+`,
 		Func: func(r Request) (data, error) {
 			res := ImportPathsResult{
 				Paths:   []string{},
+				Pkgs:    []*ImportPathInfo{},
+				Matches: []*ImportPathMatch{},
 				Imports: []ImportDecl{},
 			}
 
 			a := ImportPathsArgs{
-				Env: map[string]string{},
+				Env:   map[string]string{},
+				Limit: 50,
 			}
 
 			if err := r.Decode(&a); err != nil {
 				return res, err
 			}
 
-			res.Paths, _ = importPaths(a.Env)
+			res.Pkgs = importPkgs(a.Env, a.Fn)
+			if strings.TrimSpace(a.Query) != "" {
+				res.Matches = matchImportPaths(res.Pkgs, a.Query, projectImports(a.Fn), importUsageCounts(a.Env), a.Limit)
+				res.Pkgs = []*ImportPathInfo{}
+				for _, m := range res.Matches {
+					res.Pkgs = append(res.Pkgs, m.ImportPathInfo)
+				}
+			}
+			for _, p := range res.Pkgs {
+				res.Paths = append(res.Paths, p.Path)
+			}
+			if a.Synopsis {
+				for _, p := range res.Pkgs {
+					p.Synopsis = pkgDirSynopsis(p.Dir)
+				}
+			}
 
 			_, af, err := parseAstFile(a.Fn, a.Src, parser.ImportsOnly)
 			if err != nil {
@@ -70,49 +150,487 @@ func init() {
 }
 
 func importPaths(environ map[string]string) ([]string, error) {
-	imports := []string{
-		"unsafe",
-	}
-	paths := map[string]bool{}
-
-	env := []string{
-		environ["GOPATH"],
-		environ["GOROOT"],
-		os.Getenv("GOPATH"),
-		os.Getenv("GOROOT"),
-		runtime.GOROOT(),
-	}
-	for _, ent := range env {
-		for _, path := range filepath.SplitList(ent) {
-			if path != "" {
-				paths[path] = true
-			}
-		}
-	}
-
-	seen := map[string]bool{}
-	pfx := strings.HasPrefix
-	sfx := strings.HasSuffix
-	osArch := runtime.GOOS + "_" + runtime.GOARCH
-	for root, _ := range paths {
-		root = filepath.Join(root, "pkg", osArch)
-		walkF := func(p string, info os.FileInfo, err error) error {
-			if err == nil && !info.IsDir() {
-				p, e := filepath.Rel(root, p)
-				if e == nil && sfx(p, ".a") {
-					p := p[:len(p)-2]
-					if !pfx(p, ".") && !pfx(p, "_") && !sfx(p, "_test") {
-						p = path.Clean(filepath.ToSlash(p))
-						if !seen[p] {
-							seen[p] = true
-							imports = append(imports, p)
-						}
-					}
+	imports := []string{}
+	for _, p := range importPkgs(environ, "") {
+		imports = append(imports, p.Path)
+	}
+	return imports, nil
+}
+
+// importPkgs returns the list of packages, sorted by import path, that may be imported by the file fn.
+// Packages are discovered by looking for directories containing buildable Go files in GOROOT, GOPATH,
+// the module cache and, if fn is inside a module, that module. Packages in vendor dirs are only
+// included if they're visible to fn.
+func importPkgs(env map[string]string, fn string) []*ImportPathInfo {
+	// if the same path is found in more than one place, the first kind in this list wins
+	rank := map[string]int{
+		"vendor": 0,
+		"stdlib": 1,
+		"module": 2,
+		"gopath": 3,
+	}
+	pkgs := map[string]*ImportPathInfo{}
+	addPkg := func(p *ImportPathInfo) {
+		if old, ok := pkgs[p.Path]; ok && rank[old.Kind] <= rank[p.Kind] {
+			return
+		}
+		if p.Name = pkgDirName(p.Dir); p.Name != "" && p.Name != "main" {
+			pkgs[p.Path] = p
+		}
+	}
+
+	fnDir := ""
+	if fn != "" {
+		fnDir = filepath.Dir(fn)
+	}
+
+	goroot := gorootSrc(envGoroot(env))
+	opts := importWalkOptions()
+	walk := func(root, kind, pathPrefix string) {
+		m := walkRootDir(root, opts)
+
+		fnPath := ""
+		if rel, err := filepath.Rel(root, fnDir); fnDir != "" && err == nil && !strings.HasPrefix(rel, "..") {
+			fnPath = filepath.ToSlash(rel)
+		}
+		for importPath, _ := range m {
+			if hasPathElem(importPath, "testdata") {
+				continue
+			}
+			p := &ImportPathInfo{
+				Path: path.Join(pathPrefix, importPath),
+				Kind: kind,
+				Dir:  filepath.Join(root, filepath.FromSlash(importPath)),
+			}
+			if parent, ok := splitInternalPath(importPath); ok && !pathVisible(fnPath, parent) {
+				continue
+			}
+			if parent, vendorPath, ok := splitVendorPath(importPath); ok {
+				if !pathVisible(fnPath, parent) {
+					continue
 				}
+				p.Path = vendorPath
+				p.Kind = "vendor"
 			}
-			return nil
+			addPkg(p)
 		}
-		filepath.Walk(root, walkF)
 	}
-	return imports, nil
+
+	for _, root := range rootDirs(env) {
+		if root == goroot {
+			walk(root, "stdlib", "")
+		} else {
+			walk(root, "gopath", "")
+		}
+	}
+
+	if modRoot, modPath := findModule(fnDir); modRoot != "" {
+		walk(modRoot, "module", modPath)
+	}
+
+	for _, p := range modCachePkgs(env) {
+		addPkg(p)
+	}
+
+	l := []*ImportPathInfo{}
+	for _, p := range pkgs {
+		l = append(l, p)
+	}
+	sort.Sort(importPathInfos(l))
+	return l
+}
+
+// matchImportPaths returns the packages in pkgs matching query, best first.
+// usage is the number of times each import path is imported in the project and global the number of times
+// it's imported across GOROOT and GOPATH. If limit > 0, at most limit matches are returned
+func matchImportPaths(pkgs []*ImportPathInfo, query string, usage, global map[string]int, limit int) []*ImportPathMatch {
+	l := []*ImportPathMatch{}
+	for _, p := range pkgs {
+		score, ranges, ok := fuzzyMatch(query, p.Path)
+		if nameScore, _, nameOk := fuzzyMatch(query, p.Name); nameOk && (!ok || nameScore > score) {
+			// the name may differ from the path e.g. gopkg.in/yaml.v2 so it's only used for scoring
+			score, ok = nameScore, true
+			if ranges == nil {
+				ranges = [][2]int{}
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		m := &ImportPathMatch{
+			ImportPathInfo: p,
+			Score:          score,
+			Ranges:         ranges,
+			usage:          usage[p.Path],
+			global:         global[p.Path],
+		}
+		if strings.EqualFold(strings.TrimSpace(query), p.Name) {
+			m.Score += fuzzySegmentBonus
+		}
+		if p.Kind == "stdlib" {
+			m.Score += fuzzySegmentBonus
+		}
+		if m.usage > 0 {
+			m.Score += fuzzySegmentBonus
+		}
+		l = append(l, m)
+	}
+
+	sort.Sort(importPathMatches(l))
+	if limit > 0 && len(l) > limit {
+		l = l[:limit]
+	}
+	return l
+}
+
+type importPathMatches []*ImportPathMatch
+
+func (l importPathMatches) Len() int {
+	return len(l)
+}
+
+func (l importPathMatches) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l importPathMatches) Less(i, j int) bool {
+	p, q := l[i], l[j]
+	if p.Score != q.Score {
+		return p.Score > q.Score
+	}
+	if a, b := p.Kind == "stdlib", q.Kind == "stdlib"; a != b {
+		return a
+	}
+	if p.usage != q.usage {
+		return p.usage > q.usage
+	}
+	if p.global != q.global {
+		return p.global > q.global
+	}
+	if len(p.Path) != len(q.Path) {
+		return len(p.Path) < len(q.Path)
+	}
+	return p.Path < q.Path
+}
+
+// projectImports counts the number of times each package is imported in the project containing the file fn.
+// The project is the module containing fn or, failing that, the dir containing fn.
+// Both the walk and the counts of each dir are cached
+func projectImports(fn string) map[string]int {
+	counts := map[string]int{}
+	if fn == "" {
+		return counts
+	}
+
+	root, _ := findModule(filepath.Dir(fn))
+	if root == "" {
+		root = filepath.Dir(fn)
+	}
+
+	for _, fn := range walkRootDir(root, defaultWalkOptions()) {
+		for importPath, u := range dirImportUsage(filepath.Dir(fn)) {
+			counts[importPath] += u.Count
+		}
+	}
+	return counts
+}
+
+// importWalkOptions returns the walkOptions used to discover importable packages.
+// vendor dirs are walked because their packages may be visible to the importing file
+func importWalkOptions() walkOptions {
+	opts := defaultWalkOptions()
+	delete(opts.Skip, "vendor")
+	return opts
+}
+
+type importPathInfos []*ImportPathInfo
+
+func (l importPathInfos) Len() int {
+	return len(l)
+}
+
+func (l importPathInfos) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l importPathInfos) Less(i, j int) bool {
+	return l[i].Path < l[j].Path
+}
+
+func hasPathElem(importPath, elem string) bool {
+	return importPath == elem || strings.HasPrefix(importPath, elem+"/") ||
+		strings.HasSuffix(importPath, "/"+elem) || strings.Contains(importPath, "/"+elem+"/")
+}
+
+// splitVendorPath splits a path like `a/b/vendor/c/d` into the path of the dir containing
+// the vendor dir (`a/b`) and the path the package is imported as (`c/d`)
+func splitVendorPath(importPath string) (parent, vendorPath string, ok bool) {
+	if strings.HasPrefix(importPath, "vendor/") {
+		return "", importPath[len("vendor/"):], true
+	}
+	if i := strings.LastIndex(importPath, "/vendor/"); i >= 0 {
+		return importPath[:i], importPath[i+len("/vendor/"):], true
+	}
+	return "", "", false
+}
+
+// splitInternalPath returns the path of the dir containing the internal dir in a path like `a/b/internal/c`
+func splitInternalPath(importPath string) (parent string, ok bool) {
+	if importPath == "internal" || strings.HasPrefix(importPath, "internal/") {
+		return "", true
+	}
+	if i := strings.LastIndex(importPath, "/internal"); i >= 0 && hasPathElem(importPath[i+1:], "internal") {
+		return importPath[:i], true
+	}
+	return "", false
+}
+
+// pathVisible reports whether the vendor or internal packages in the dir parent are visible to fnPath.
+// Both paths are relative to the same root and an empty fnPath means the file is not in that root
+func pathVisible(fnPath, parent string) bool {
+	if fnPath == "" {
+		return false
+	}
+	return parent == "" || fnPath == parent || strings.HasPrefix(fnPath, parent+"/")
+}
+
+// pkgDirName returns the name of the package in dir, ignoring test files and files excluded by build constraints.
+// An empty string is returned if the dir doesn't contain a buildable package.
+func pkgDirName(dir string) string {
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		return ""
+	}
+
+	pkgNamesLck.Lock()
+	ent, ok := pkgNamesCache[dir]
+	pkgNamesLck.Unlock()
+	if ok && ent.modTime.Equal(fi.ModTime()) {
+		return ent.name
+	}
+
+	ent = pkgNameEnt{
+		modTime: fi.ModTime(),
+	}
+	if l, err := ioutil.ReadDir(dir); err == nil {
+		fset := token.NewFileSet()
+		for _, fi := range l {
+			name := fi.Name()
+			if fi.IsDir() || !isGoFile(fi) || strings.HasSuffix(name, "_test.go") {
+				continue
+			}
+			if ok, err := build.Default.MatchFile(dir, name); err != nil || !ok {
+				continue
+			}
+			af, _ := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.PackageClauseOnly)
+			if af != nil && af.Name != nil && af.Name.Name != "documentation" {
+				ent.name = af.Name.Name
+				break
+			}
+		}
+	}
+
+	pkgNamesLck.Lock()
+	pkgNamesCache[dir] = ent
+	pkgNamesLck.Unlock()
+	return ent.name
+}
+
+// pkgDirSynopsis returns the first sentence of the documentation of the package in dir.
+// It's only computed when asked for and cached until the dir is modified
+func pkgDirSynopsis(dir string) string {
+	name := pkgDirName(dir)
+	if name == "" {
+		return ""
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return ""
+	}
+	pkgSynopsesLck.Lock()
+	ent, ok := pkgSynopsesCache[dir]
+	pkgSynopsesLck.Unlock()
+	if ok && ent.modTime.Equal(fi.ModTime()) {
+		return ent.synopsis
+	}
+
+	ent = pkgSynopsisEnt{
+		modTime: fi.ModTime(),
+	}
+	if l, err := ioutil.ReadDir(dir); err == nil {
+		// the package doc is conventionally in doc.go so we look there first
+		for i, fi := range l {
+			if fi.Name() == "doc.go" {
+				l[0], l[i] = l[i], l[0]
+				break
+			}
+		}
+		fset := token.NewFileSet()
+		for _, fi := range l {
+			fn := fi.Name()
+			if fi.IsDir() || !isGoFile(fi) || strings.HasSuffix(fn, "_test.go") {
+				continue
+			}
+			if ok, err := build.Default.MatchFile(dir, fn); err != nil || !ok {
+				continue
+			}
+			af, _ := parser.ParseFile(fset, filepath.Join(dir, fn), nil, parser.PackageClauseOnly|parser.ParseComments)
+			if af != nil && af.Name != nil && af.Name.Name == name && af.Doc != nil {
+				ent.synopsis = doc.Synopsis(af.Doc.Text())
+				break
+			}
+		}
+	}
+
+	pkgSynopsesLck.Lock()
+	pkgSynopsesCache[dir] = ent
+	pkgSynopsesLck.Unlock()
+	return ent.synopsis
+}
+
+// findModule returns the root dir and module path of the module containing dir
+func findModule(dir string) (modRoot, modPath string) {
+	for dir != "" {
+		if s, err := ioutil.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+			if m := modPathRe.FindSubmatch(s); m != nil {
+				return dir, string(m[1])
+			}
+			return "", ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return "", ""
+}
+
+func modCacheDir(env map[string]string) string {
+	if dir := env["GOMODCACHE"]; dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir
+	}
+	gopath := env["GOPATH"]
+	if gopath == "" {
+		gopath = os.Getenv("GOPATH")
+	}
+	if gopath == "" {
+		gopath = build.Default.GOPATH
+	}
+	for _, dir := range filepath.SplitList(gopath) {
+		if dir != "" {
+			return filepath.Join(dir, "pkg", "mod")
+		}
+	}
+	return ""
+}
+
+// modCachePkgs returns the packages in the module cache. If there are several versions of a module,
+// only the latest one is considered.
+func modCachePkgs(env map[string]string) []*ImportPathInfo {
+	pkgs := []*ImportPathInfo{}
+	root := modCacheDir(env)
+	if root == "" {
+		return pkgs
+	}
+
+	m := walkRootDir(root, importWalkOptions())
+
+	type modVer struct {
+		ver  string
+		pkgs []*ImportPathInfo
+	}
+	mods := map[string]*modVer{}
+	for importPath, _ := range m {
+		if strings.HasPrefix(importPath, "cache/") || hasPathElem(importPath, "testdata") {
+			continue
+		}
+		i := strings.Index(importPath, "@")
+		if i < 0 {
+			continue
+		}
+		modPath := unescapeModPath(importPath[:i])
+		ver, rest := importPath[i+1:], ""
+		if j := strings.Index(ver, "/"); j >= 0 {
+			ver, rest = ver[:j], ver[j+1:]
+		}
+		if _, _, ok := splitVendorPath(rest); ok {
+			continue
+		}
+		if _, ok := splitInternalPath(rest); ok {
+			continue
+		}
+
+		mv, ok := mods[modPath]
+		if !ok || semverLess(mv.ver, ver) {
+			mv = &modVer{ver: ver}
+			mods[modPath] = mv
+		} else if mv.ver != ver {
+			continue
+		}
+		mv.pkgs = append(mv.pkgs, &ImportPathInfo{
+			Path: path.Join(modPath, rest),
+			Kind: "module",
+			Dir:  filepath.Join(root, filepath.FromSlash(importPath)),
+		})
+	}
+
+	for _, mv := range mods {
+		pkgs = append(pkgs, mv.pkgs...)
+	}
+	return pkgs
+}
+
+// unescapeModPath reverses the module cache's case-encoding e.g. `github.com/!burnt!sushi` -> `github.com/BurntSushi`
+func unescapeModPath(s string) string {
+	buf := make([]rune, 0, len(s))
+	upper := false
+	for _, r := range s {
+		if r == '!' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		buf = append(buf, r)
+	}
+	return string(buf)
+}
+
+// semverLess reports whether version a is older than b, e.g. v1.9.0 < v1.10.0 and v1.0.0-rc1 < v1.0.0
+func semverLess(a, b string) bool {
+	split := func(s string) (core []string, pre string) {
+		s = strings.TrimPrefix(s, "v")
+		if i := strings.IndexAny(s, "-+"); i >= 0 {
+			s, pre = s[:i], s[i:]
+		}
+		return strings.Split(s, "."), pre
+	}
+	ca, pa := split(a)
+	cb, pb := split(b)
+	for i := 0; i < len(ca) && i < len(cb); i++ {
+		x, errX := strconv.Atoi(ca[i])
+		y, errY := strconv.Atoi(cb[i])
+		if errX != nil || errY != nil {
+			if ca[i] != cb[i] {
+				return ca[i] < cb[i]
+			}
+		} else if x != y {
+			return x < y
+		}
+	}
+	if len(ca) != len(cb) {
+		return len(ca) < len(cb)
+	}
+	if (pa == "") != (pb == "") {
+		return pa != ""
+	}
+	return pa < pb
 }
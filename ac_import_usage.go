@@ -0,0 +1,234 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	importUsageLck   = sync.Mutex{}
+	importUsageCache = map[string]*importUsageEnt{}
+)
+
+// importUsageEnt holds the import counts of the files in a single dir
+type importUsageEnt struct {
+	modTime time.Time
+	paths   map[string]*ImportUsage
+}
+
+type ImportUsageArgs struct {
+	Env   map[string]string `json:"env"`
+	Paths []string          `json:"paths"`
+}
+
+// ImportUsage is the number of times a package is imported and the number of times each alias is used to import it
+type ImportUsage struct {
+	Count   int            `json:"count"`
+	Aliases map[string]int `json:"aliases"`
+}
+
+func init() {
+	act(Action{
+		Path: "/import_usage",
+		Doc: `
+counts how often each package is imported by the files in GOROOT and GOPATH, vendored packages included, and the aliases it's imported as
+@data: {"env": {}, "paths": ["encoding/json"]}
+@resp: {"encoding/json": {"count": 10, "aliases": {"js": 1}}}
+if paths is empty, the counts of all packages are returned
+`,
+		Func: func(r Request) (data, error) {
+			res := map[string]*ImportUsage{}
+			a := ImportUsageArgs{
+				Env: map[string]string{},
+			}
+			if err := r.Decode(&a); err != nil {
+				return res, err
+			}
+
+			usage := importUsage(a.Env)
+			if len(a.Paths) == 0 {
+				return usage, nil
+			}
+			for _, importPath := range a.Paths {
+				if u, ok := usage[importPath]; ok {
+					res[importPath] = u
+				} else {
+					res[importPath] = &ImportUsage{Aliases: map[string]int{}}
+				}
+			}
+			return res, nil
+		},
+	})
+}
+
+var (
+	importUsageIdxLck = sync.Mutex{}
+	importUsageIdxs   = map[string]*importUsageIdx{}
+)
+
+// importUsageIdx holds the import counts of all the package dirs in a root dir.
+// It's kept up-to-date one dir at a time, so only the dirs that were modified are parsed again
+type importUsageIdx struct {
+	mu    sync.Mutex
+	dirs  map[string]*importUsageEnt
+	usage map[string]*ImportUsage
+}
+
+// update brings the index up-to-date with the package dirs in root
+func (idx *importUsageIdx) update(root string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, fn := range walkRootDir(root, importWalkOptions()) {
+		dir := filepath.Dir(fn)
+		seen[dir] = true
+		ent := dirImportUsageEnt(dir)
+		old, ok := idx.dirs[dir]
+		if ok && old == ent {
+			continue
+		}
+		if ok {
+			idx.add(old, -1)
+		}
+		if ent == nil {
+			delete(idx.dirs, dir)
+			continue
+		}
+		idx.add(ent, 1)
+		idx.dirs[dir] = ent
+	}
+	for dir, ent := range idx.dirs {
+		if !seen[dir] {
+			idx.add(ent, -1)
+			delete(idx.dirs, dir)
+		}
+	}
+}
+
+// add adds the counts in ent to the index, or removes them if sign is negative
+func (idx *importUsageIdx) add(ent *importUsageEnt, sign int) {
+	for importPath, u := range ent.paths {
+		iu, ok := idx.usage[importPath]
+		if !ok {
+			iu = &ImportUsage{Aliases: map[string]int{}}
+			idx.usage[importPath] = iu
+		}
+		iu.Count += sign * u.Count
+		for name, n := range u.Aliases {
+			if iu.Aliases[name] += sign * n; iu.Aliases[name] <= 0 {
+				delete(iu.Aliases, name)
+			}
+		}
+		if iu.Count <= 0 {
+			delete(idx.usage, importPath)
+		}
+	}
+}
+
+// importUsage returns the import counts for all the files in the package dirs of rootDirs, including vendored packages.
+// The counts are kept in an index per root dir in which only the dirs that were modified are re-counted
+func importUsage(env map[string]string) map[string]*ImportUsage {
+	res := map[string]*ImportUsage{}
+	for _, root := range rootDirs(env) {
+		importUsageIdxLck.Lock()
+		idx, ok := importUsageIdxs[root]
+		if !ok {
+			idx = &importUsageIdx{
+				dirs:  map[string]*importUsageEnt{},
+				usage: map[string]*ImportUsage{},
+			}
+			importUsageIdxs[root] = idx
+		}
+		importUsageIdxLck.Unlock()
+
+		idx.update(root)
+
+		idx.mu.Lock()
+		for importPath, u := range idx.usage {
+			ru, ok := res[importPath]
+			if !ok {
+				ru = &ImportUsage{Aliases: map[string]int{}}
+				res[importPath] = ru
+			}
+			ru.Count += u.Count
+			for name, n := range u.Aliases {
+				ru.Aliases[name] += n
+			}
+		}
+		idx.mu.Unlock()
+	}
+	return res
+}
+
+// importUsageCounts returns the number of times each package is imported
+func importUsageCounts(env map[string]string) map[string]int {
+	counts := map[string]int{}
+	for importPath, u := range importUsage(env) {
+		counts[importPath] = u.Count
+	}
+	return counts
+}
+
+// dirImportUsage returns the import counts of the files in dir
+func dirImportUsage(dir string) map[string]*ImportUsage {
+	if ent := dirImportUsageEnt(dir); ent != nil {
+		return ent.paths
+	}
+	return nil
+}
+
+// dirImportUsageEnt returns the cached import counts of dir, counting them again if the dir was modified.
+// The same entry is returned for as long as the dir is unchanged
+func dirImportUsageEnt(dir string) *importUsageEnt {
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		return nil
+	}
+
+	importUsageLck.Lock()
+	ent, ok := importUsageCache[dir]
+	importUsageLck.Unlock()
+	if ok && ent.modTime.Equal(fi.ModTime()) {
+		return ent
+	}
+
+	ent = &importUsageEnt{
+		modTime: fi.ModTime(),
+		paths:   map[string]*ImportUsage{},
+	}
+	if l, err := ioutil.ReadDir(dir); err == nil {
+		fset := token.NewFileSet()
+		for _, fi := range l {
+			if fi.IsDir() || !isGoFile(fi) {
+				continue
+			}
+			af, _ := parser.ParseFile(fset, filepath.Join(dir, fi.Name()), nil, parser.ImportsOnly)
+			if af == nil {
+				continue
+			}
+			for _, ispec := range af.Imports {
+				importPath := unquote(ispec.Path.Value)
+				u, ok := ent.paths[importPath]
+				if !ok {
+					u = &ImportUsage{Aliases: map[string]int{}}
+					ent.paths[importPath] = u
+				}
+				u.Count += 1
+				if ispec.Name != nil {
+					u.Aliases[ispec.Name.Name] += 1
+				}
+			}
+		}
+	}
+
+	importUsageLck.Lock()
+	importUsageCache[dir] = ent
+	importUsageLck.Unlock()
+	return ent
+}
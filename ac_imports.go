@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 )
 
 type ImportDecl struct {
@@ -19,16 +26,34 @@ type ImportDeclArg struct {
 }
 
 type ImportsResult struct {
-	Src     string `json:"src"`
-	LineRef int    `json:"line_ref"`
+	Src       string            `json:"src"`
+	LineRef   int               `json:"line_ref"`
+	Edits     []*TextEdit       `json:"edits"`
+	Offsets   []int             `json:"offsets"`
+	Conflicts []*ImportConflict `json:"conflicts"`
+	Aliases   []ImportDecl      `json:"aliases"`
+}
+
+// ImportConflict describes an import whose name collides with another import or a top-level declaration
+type ImportConflict struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// With is the path of the other import, or empty if the collision is with a declaration
+	With string `json:"with"`
+	Kind string `json:"kind"`
 }
 
 type ImportsArgs struct {
-	Fn        string          `json:"fn"`
-	Src       string          `json:"src"`
-	Toggle    []ImportDeclArg `json:"toggle"`
-	TabWidth  int             `json:"tab_width"`
-	TabIndent bool            `json:"tab_indent"`
+	Fn           string            `json:"fn"`
+	Src          string            `json:"src"`
+	Toggle       []ImportDeclArg   `json:"toggle"`
+	TabWidth     int               `json:"tab_width"`
+	TabIndent    bool              `json:"tab_indent"`
+	Edits        bool              `json:"edits"`
+	Offsets      []int             `json:"offsets"`
+	ImportGroups []ImportGroup     `json:"import_groups"`
+	AutoAlias    bool              `json:"auto_alias"`
+	Env          map[string]string `json:"env"`
 }
 
 func unquote(s string) string {
@@ -50,13 +75,24 @@ func init() {
 				Toggle:    []ImportDeclArg{},
 				TabWidth:  8,
 				TabIndent: true,
+				Env:       map[string]string{},
 			}
 
 			if err := r.Decode(&a); err != nil {
 				return res, err
 			}
 
-			fset, af, err := parseAstFile(a.Fn, a.Src, parser.ImportsOnly|parser.ParseComments)
+			src, err := readSrc(a.Fn, a.Src)
+			if err != nil {
+				return res, err
+			}
+
+			// cgo preambles must stay attached to `import "C"` so we separate it from the other imports.
+			// the split adds lines to the import section which we need to account for in LineRef
+			cgoSrc := splitImportC(src)
+			cgoLines := strings.Count(cgoSrc, "\n") - strings.Count(src, "\n")
+
+			fset, af, err := parseAstFile(a.Fn, cgoSrc, parser.ImportsOnly|parser.ParseComments)
 			if err == nil {
 				// we neither return, nor attempt the whole source because it likely contains
 				// syntax errors after the imports... as a result we need to tell the client
@@ -79,15 +115,47 @@ func init() {
 					}
 				}
 
-				af = imp(fset, af, a.Toggle)
-				res.Src, err = printSrc(fset, af, a.TabIndent, a.TabWidth)
+				var toggle []ImportDeclArg
+				res.Conflicts, res.Aliases, toggle = importConflicts(a.Fn, src, af, a.Toggle, a.AutoAlias, rootDirs(a.Env))
+				fset, af, err = imp(fset, af, toggle)
+				if err == nil {
+					res.Src, err = printSrc(fset, af, a.TabIndent, a.TabWidth)
+				}
+				if err == nil {
+					res.Src, err = groupImports(res.Src, a.ImportGroups, a.TabIndent, a.TabWidth)
+				}
+
+				res.LineRef -= cgoLines
+				lines := splitLines(src)
+				if len(lines) > res.LineRef {
+					lines = lines[:res.LineRef]
+				}
+				head := strings.Join(lines, "")
+
+				// the edits are relative to the original source so they may be applied
+				// directly, without the need to patch using LineRef
+				if err == nil && a.Edits {
+					res.Edits = textEdits(head, res.Src)
+				}
+
+				// offsets are relative to the whole source, after it has been patched
+				if err == nil && a.Offsets != nil {
+					res.Offsets = mapOffsets(head, res.Src, a.Offsets)
+					for i, o := range a.Offsets {
+						if o >= len(head) {
+							res.Offsets[i] = o + len(res.Src) - len(head)
+						}
+					}
+				}
 			}
 			return res, err
 		},
 	})
 }
 
-func imp(fset *token.FileSet, af *ast.File, toggle []ImportDeclArg) *ast.File {
+// imp adds and removes the imports in toggle.
+// The returned file may have been re-parsed so the returned fset must be used in its place.
+func imp(fset *token.FileSet, af *ast.File, toggle []ImportDeclArg) (*token.FileSet, *ast.File, error) {
 	add := map[ImportDecl]bool{}
 	del := map[ImportDecl]bool{}
 	for _, sda := range toggle {
@@ -102,11 +170,13 @@ func imp(fset *token.FileSet, af *ast.File, toggle []ImportDeclArg) *ast.File {
 		}
 	}
 
-	var firstDecl *ast.GenDecl
 	imports := map[ImportDecl]bool{}
+	// comments that belong to the specs and decls that are removed
+	dropComments := map[*ast.CommentGroup]bool{}
+	declSpans := map[*ast.GenDecl][2]token.Pos{}
 	for _, decl := range af.Decls {
-		if gdecl, ok := decl.(*ast.GenDecl); ok && len(gdecl.Specs) > 0 {
-			hasC := false
+		if gdecl, ok := decl.(*ast.GenDecl); ok && gdecl.Tok == token.IMPORT && len(gdecl.Specs) > 0 {
+			declSpans[gdecl] = [2]token.Pos{gdecl.Pos(), gdecl.End()}
 			sj := 0
 			for _, spec := range gdecl.Specs {
 				if ispec, ok := spec.(*ast.ImportSpec); ok {
@@ -118,13 +188,15 @@ func imp(fset *token.FileSet, af *ast.File, toggle []ImportDeclArg) *ast.File {
 					}
 
 					if sd.Path == "C" {
-						hasC = true
+						// `import "C"` is left alone, along with its cgo preamble
 					} else if del[sd] {
 						if sj > 0 {
 							if lspec, ok := gdecl.Specs[sj-1].(*ast.ImportSpec); ok {
 								lspec.EndPos = ispec.Pos()
 							}
 						}
+						dropComments[ispec.Doc] = true
+						dropComments[ispec.Comment] = true
 						continue
 					} else {
 						imports[sd] = true
@@ -135,55 +207,825 @@ func imp(fset *token.FileSet, af *ast.File, toggle []ImportDeclArg) *ast.File {
 				sj += 1
 			}
 			gdecl.Specs = gdecl.Specs[:sj]
+		}
+	}
 
-			if !hasC && firstDecl == nil {
-				firstDecl = gdecl
+	dj := 0
+	for _, decl := range af.Decls {
+		if gdecl, ok := decl.(*ast.GenDecl); ok && gdecl.Tok == token.IMPORT {
+			if len(gdecl.Specs) == 0 {
+				dropComments[gdecl.Doc] = true
+				if sp, ok := declSpans[gdecl]; ok {
+					for _, cg := range af.Comments {
+						if cg.Pos() >= sp[0] && cg.End() <= sp[1] {
+							dropComments[cg] = true
+						}
+					}
+				}
+				continue
 			}
 		}
+		af.Decls[dj] = decl
+		dj += 1
 	}
+	af.Decls = af.Decls[:dj]
 
-	if len(add) > 0 {
-		if firstDecl == nil {
-			firstDecl = &ast.GenDecl{
-				Tok:    token.IMPORT,
-				Lparen: 1,
+	if len(dropComments) > 0 {
+		cj := 0
+		for _, cg := range af.Comments {
+			if !dropComments[cg] {
+				af.Comments[cj] = cg
+				cj += 1
 			}
-			af.Decls = append(af.Decls, firstDecl)
-		} else if firstDecl.Lparen == token.NoPos {
-			firstDecl.Lparen = 1
 		}
+		af.Comments = af.Comments[:cj]
+	}
 
-		for sd, _ := range add {
-			if !imports[sd] {
-				ispec := &ast.ImportSpec{
-					Path: &ast.BasicLit{
-						Value: quote(sd.Path),
-						Kind:  token.STRING,
-					},
-				}
-				if sd.Name != "" {
-					ispec.Name = &ast.Ident{
-						Name: sd.Name,
-					}
+	specs := []string{}
+	for sd, _ := range add {
+		if !imports[sd] {
+			spec := quote(sd.Path)
+			if sd.Name != "" {
+				spec = sd.Name + " " + spec
+			}
+			specs = append(specs, spec)
+		}
+	}
+
+	if len(specs) == 0 {
+		ast.SortImports(fset, af)
+		return fset, af, nil
+	}
+
+	// the printer places comments based on the position of the nodes around them
+	// and because new specs don't have a (unique) position, the comments are likely to be misplaced.
+	// to avoid that, the new specs are added to the source which is then re-parsed
+	fn := fset.Position(af.Pos()).Filename
+	src, err := printSrc(fset, af, true, 8)
+	if err != nil {
+		return fset, af, err
+	}
+	src, err = addImportSpecs(src, specs)
+	if err != nil {
+		return fset, af, err
+	}
+	fset, af, err = parseAstFile(fn, src, parser.ParseComments)
+	if err != nil {
+		return fset, af, err
+	}
+	ast.SortImports(fset, af)
+	return fset, af, nil
+}
+
+// addImportSpecs adds specs to the first import decl in src, excluding `import "C"`.
+// If there is no such decl, a new one is added after the package clause.
+func addImportSpecs(src string, specs []string) (string, error) {
+	fset, af, err := parseAstFile("", src, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return src, err
+	}
+
+	sort.Strings(specs)
+	ds := importDeclSource{fset, src}
+	for _, decl := range af.Decls {
+		gdecl, ok := decl.(*ast.GenDecl)
+		if !ok || gdecl.Tok != token.IMPORT || declImportsC(gdecl) {
+			continue
+		}
+
+		if gdecl.Lparen.IsValid() {
+			pos := ds.offset(gdecl.Rparen)
+			ls := strings.LastIndex(src[:pos], "\n") + 1
+			if strings.TrimSpace(src[ls:pos]) == "" {
+				// the usual case where the closing paren is on its own line
+				return src[:ls] + "\t" + strings.Join(specs, "\n\t") + "\n" + src[ls:], nil
+			}
+			return src[:pos] + "\n\t" + strings.Join(specs, "\n\t") + "\n" + src[pos:], nil
+		}
+
+		// convert `import "x"` into a block, keeping any line comment with the spec
+		start, end := ds.span(gdecl, false)
+		chunks, _ := ds.chunks(gdecl, false)
+		block := "import (\n\t" + chunks[0].spec + "\n\t" + strings.Join(specs, "\n\t") + "\n)\n"
+		return src[:start] + block + src[end:], nil
+	}
+
+	// at this point, the only imports, if any, are `import "C"` so the new decl goes above them all,
+	// keeping the cgo preamble together with its decl
+	pos := ds.lineEnd(ds.offset(af.Name.End()), len(src))
+	block := "\nimport (\n\t" + strings.Join(specs, "\n\t") + "\n)\n"
+	if pos == len(src) && !strings.HasSuffix(src, "\n") {
+		block = "\n" + block
+	}
+	return src[:pos] + block + src[pos:], nil
+}
+
+// importName returns the name a package is likely to be imported as when it's not aliased
+// e.g. `gopkg.in/yaml.v2` is imported as `yaml` and `github.com/x/go-foo/v2` as `foo`
+func importName(importPath string) string {
+	l := strings.Split(importPath, "/")
+	name := l[len(l)-1]
+	if len(l) > 1 && len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		name = l[len(l)-2]
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		name = name[:i]
+	}
+	name = strings.TrimPrefix(name, "go-")
+	name = strings.TrimSuffix(name, "-go")
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// pkgNameOf returns the name declared by the package importPath, or its likely name if it cannot be found
+func pkgNameOf(importPath string, srcRootDirs []string) string {
+	for _, dir := range srcRootDirs {
+		if name := pkgDirName(filepath.Join(dir, filepath.FromSlash(importPath))); name != "" {
+			return name
+		}
+	}
+	return importName(importPath)
+}
+
+// importConflicts finds the imports that will be added by toggle whose name collides with another import,
+// or top-level declaration in the package that af (the file fn, whose source is src) belongs to.
+// If autoAlias is true, the entries of the returned copy of toggle are given a unique name and they're listed in aliases.
+// Nothing is looked up unless toggle adds an import that isn't already in af
+func importConflicts(fn, src string, af *ast.File, toggle []ImportDeclArg, autoAlias bool, srcRootDirs []string) (conflicts []*ImportConflict, aliases []ImportDecl, aliased []ImportDeclArg) {
+	conflicts = []*ImportConflict{}
+	aliases = []ImportDecl{}
+	aliased = append([]ImportDeclArg{}, toggle...)
+
+	del := map[ImportDecl]bool{}
+	for _, sda := range toggle {
+		if !sda.Add {
+			del[ImportDecl{Path: sda.Path, Name: sda.Name}] = true
+		}
+	}
+	imported := map[ImportDecl]bool{}
+	for _, ispec := range af.Imports {
+		sd := ImportDecl{
+			Path: unquote(ispec.Path.Value),
+		}
+		if ispec.Name != nil {
+			sd.Name = ispec.Name.Name
+		}
+		imported[sd] = true
+	}
+
+	// the imports that are actually added
+	added := []int{}
+	for i, sda := range toggle {
+		if sda.Add && sda.Path != "C" && !imported[ImportDecl{Path: sda.Path, Name: sda.Name}] {
+			added = append(added, i)
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+
+	// the name of each import that remains after the toggle
+	names := map[string]string{}
+	for _, ispec := range af.Imports {
+		sd := ImportDecl{
+			Path: unquote(ispec.Path.Value),
+		}
+		if ispec.Name != nil {
+			sd.Name = ispec.Name.Name
+		}
+		if sd.Path == "C" || del[sd] {
+			continue
+		}
+		names[resolvedSpecName(ispec, srcRootDirs)] = sd.Path
+	}
+
+	// af only contains the imports so we need to parse the rest of the file to find its declarations.
+	// it's likely to be incomplete so we make do with whatever can be parsed
+	decls := map[string]bool{}
+	if _, full, _ := parseAstFile(fn, src, 0); full != nil && full.Name != nil {
+		decls, _ = pkgContext(fn, full)
+	}
+
+	for _, i := range added {
+		sda := toggle[i]
+		name := sda.Name
+		if name == "" {
+			name = pkgNameOf(sda.Path, srcRootDirs)
+		}
+		if name == "_" || name == "." {
+			continue
+		}
+
+		c := &ImportConflict{
+			Name: name,
+			Path: sda.Path,
+		}
+		if p, ok := names[name]; ok && p != sda.Path {
+			c.Kind = "import"
+			c.With = p
+		} else if decls[name] {
+			c.Kind = "declaration"
+		} else {
+			names[name] = sda.Path
+			continue
+		}
+		conflicts = append(conflicts, c)
+
+		if autoAlias {
+			alias := importAlias(sda.Path, name, func(s string) bool {
+				_, taken := names[s]
+				return taken || decls[s]
+			})
+			aliased[i].Name = alias
+			names[alias] = sda.Path
+			aliases = append(aliases, ImportDecl{
+				Name: alias,
+				Path: sda.Path,
+			})
+		}
+	}
+	return
+}
+
+// importAlias returns a name for the import importPath that is not taken
+// e.g. `htmltemplate` for `html/template` or `template2` if that's taken as well
+func importAlias(importPath, name string, taken func(string) bool) string {
+	l := strings.Split(importPath, "/")
+	if len(l) > 1 {
+		alias := strings.Replace(importName(strings.Join(l[:len(l)-1], "/")), "_", "", -1) + name
+		if !taken(alias) {
+			return alias
+		}
+	}
+	for i := 2; ; i++ {
+		alias := fmt.Sprintf("%s%d", name, i)
+		if !taken(alias) {
+			return alias
+		}
+	}
+}
+
+// specName returns the name by which the package imported by ispec is referred to in the file
+func specName(ispec *ast.ImportSpec) string {
+	if ispec.Name != nil {
+		return ispec.Name.Name
+	}
+	return importName(unquote(ispec.Path.Value))
+}
+
+// resolvedSpecName returns the name by which the package imported by ispec is referred to in the file,
+// using the name declared by the package when it's not aliased
+func resolvedSpecName(ispec *ast.ImportSpec, srcRootDirs []string) string {
+	if ispec.Name != nil {
+		return ispec.Name.Name
+	}
+	if importPath := unquote(ispec.Path.Value); importPath != "C" {
+		return pkgNameOf(importPath, srcRootDirs)
+	}
+	return ""
+}
+
+// isStdlibPath reports whether importPath looks like it belongs to the standard library
+// i.e. its first element is not a domain name
+func isStdlibPath(importPath string) bool {
+	l := strings.SplitN(importPath, "/", 2)
+	return !strings.Contains(l[0], ".")
+}
+
+// unresolvedSelectors returns the set of selectors (x.Sel) where x is not declared in af or in the package scope
+// it's keyed by x's name and lists the selected names
+func unresolvedSelectors(af *ast.File, pkgScope map[string]bool) map[string]map[string]bool {
+	refs := map[string]map[string]bool{}
+	ast.Inspect(af, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Obj == nil && !pkgScope[x.Name] {
+				m, ok := refs[x.Name]
+				if !ok {
+					m = map[string]bool{}
+					refs[x.Name] = m
 				}
-				firstDecl.Specs = append(firstDecl.Specs, ispec)
-				imports[sd] = true
+				m[sel.Sel.Name] = true
+			}
+		}
+		return true
+	})
+	return refs
+}
+
+// fixImports works out which imports need to be added to, or removed from, af like goimports does.
+// unresolved selectors are resolved against the list of known import paths, preferring the standard library,
+// then the paths already imported by other files in the same package, then shorter paths.
+// The returned list is suitable for use with imp()
+func fixImports(fset *token.FileSet, fn string, af *ast.File, env map[string]string) []ImportDeclArg {
+	toggle := []ImportDeclArg{}
+	pkgScope, pkgImports := pkgContext(fn, af)
+	refs := unresolvedSelectors(af, pkgScope)
+	srcRootDirs := rootDirs(env)
+	imported := map[string]bool{}
+	for _, ispec := range af.Imports {
+		importPath := unquote(ispec.Path.Value)
+		// the name guessed from the path isn't good enough here, e.g. `github.com/x/gopher-lua` declares `lua`,
+		// and getting it wrong would remove an import that's used
+		name := resolvedSpecName(ispec, srcRootDirs)
+		imported[name] = true
+		if name == "_" || name == "." || importPath == "C" {
+			continue
+		}
+		if _, used := refs[name]; !used {
+			sd := ImportDeclArg{
+				Path: importPath,
 			}
+			if ispec.Name != nil {
+				sd.Name = ispec.Name.Name
+			}
+			toggle = append(toggle, sd)
 		}
 	}
 
-	dj := 0
+	missing := map[string]map[string]bool{}
+	for name, sels := range refs {
+		if !imported[name] {
+			missing[name] = sels
+		}
+	}
+	if len(missing) == 0 {
+		return toggle
+	}
+
+	known := knownImportPaths(env, fn)
+	candidates := map[string][]string{}
+	for importPath, p := range known {
+		if missing[p.Name] != nil {
+			candidates[p.Name] = append(candidates[p.Name], importPath)
+		}
+	}
+
+	// the global counts are only needed to choose between candidates
+	var globalImports map[string]int
+	for name, l := range candidates {
+		if len(l) > 1 && globalImports == nil {
+			globalImports = importUsageCounts(env)
+		}
+		sort.Sort(importCandidates{l, pkgImports, globalImports})
+		importPath := ""
+		for _, p := range l {
+			if pkgExports(known[p].Dir, name, missing[name]) {
+				importPath = p
+				break
+			}
+		}
+		if importPath == "" {
+			continue
+		}
+		toggle = append(toggle, ImportDeclArg{
+			Path: importPath,
+			Add:  true,
+		})
+	}
+	return toggle
+}
+
+// pkgContext returns the names declared at the top-level of the package that af (the file fn) belongs to
+// and the number of times each import path is imported by the other files in the package
+func pkgContext(fn string, af *ast.File) (scope map[string]bool, imports map[string]int) {
+	scope = map[string]bool{}
+	imports = map[string]int{}
+	if af.Scope != nil {
+		for name, _ := range af.Scope.Objects {
+			scope[name] = true
+		}
+	}
+	if fn == "" {
+		return
+	}
+
+	dir := filepath.Dir(fn)
+	l, _ := ioutil.ReadDir(dir)
+	for _, fi := range l {
+		if fi.IsDir() || !isGoFile(fi) || fi.Name() == filepath.Base(fn) {
+			continue
+		}
+		ent := fileDecls(filepath.Join(dir, fi.Name()), fi)
+		if ent.pkgName != af.Name.Name {
+			continue
+		}
+		for _, name := range ent.names {
+			scope[name] = true
+		}
+		for _, p := range ent.imports {
+			imports[p] += 1
+		}
+	}
+	return
+}
+
+var (
+	fileDeclsLck   = sync.Mutex{}
+	fileDeclsCache = map[string]*fileDeclsEnt{}
+)
+
+// fileDeclsEnt holds the names declared at the top-level of a file, and the paths it imports
+type fileDeclsEnt struct {
+	stamp   fileStamp
+	pkgName string
+	names   []string
+	imports []string
+}
+
+// fileDecls returns the top-level declarations of the file fn, whose FileInfo is fi.
+// They're cached until the file's size or modification time changes
+func fileDecls(fn string, fi os.FileInfo) *fileDeclsEnt {
+	stamp := fileStamp{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+	}
+	fileDeclsLck.Lock()
+	ent := fileDeclsCache[fn]
+	fileDeclsLck.Unlock()
+	if ent != nil && ent.stamp.same(stamp) {
+		return ent
+	}
+
+	ent = &fileDeclsEnt{
+		stamp: stamp,
+	}
+	if af, _ := parser.ParseFile(token.NewFileSet(), fn, nil, 0); af != nil && af.Name != nil {
+		ent.pkgName = af.Name.Name
+		for name, _ := range af.Scope.Objects {
+			ent.names = append(ent.names, name)
+		}
+		for _, ispec := range af.Imports {
+			ent.imports = append(ent.imports, unquote(ispec.Path.Value))
+		}
+	}
+
+	fileDeclsLck.Lock()
+	fileDeclsCache[fn] = ent
+	fileDeclsLck.Unlock()
+	return ent
+}
+
+// knownImportPaths returns the packages that may be imported by the file fn, keyed by import path
+// The root dirs are walked with importWalkOptions, the same cached walks that importUsageCounts counts from,
+// so neither lookup reads dirs that haven't changed since the last call
+func knownImportPaths(env map[string]string, fn string) map[string]*ImportPathInfo {
+	known := map[string]*ImportPathInfo{}
+	for _, p := range importPkgs(env, fn) {
+		known[p.Path] = p
+	}
+	return known
+}
+
+// importCandidates sorts import paths by preference: stdlib, then usage in the package,
+// then usage across GOROOT and GOPATH, then length
+type importCandidates struct {
+	paths  []string
+	usage  map[string]int
+	global map[string]int
+}
+
+func (c importCandidates) Len() int {
+	return len(c.paths)
+}
+
+func (c importCandidates) Swap(i, j int) {
+	c.paths[i], c.paths[j] = c.paths[j], c.paths[i]
+}
+
+func (c importCandidates) Less(i, j int) bool {
+	p, q := c.paths[i], c.paths[j]
+	if a, b := isStdlibPath(p), isStdlibPath(q); a != b {
+		return a
+	}
+	if a, b := c.usage[p], c.usage[q]; a != b {
+		return a > b
+	}
+	if a, b := c.global[p], c.global[q]; a != b {
+		return a > b
+	}
+	if len(p) != len(q) {
+		return len(p) < len(q)
+	}
+	return p < q
+}
+
+// pkgExports reports whether the package name in dir declares all the exported names in sels
+func pkgExports(dir, name string, sels map[string]bool) bool {
+	pkgs, _ := parser.ParseDir(token.NewFileSet(), dir, isGoFile, 0)
+	pkg, ok := pkgs[name]
+	if !ok {
+		return false
+	}
+	scope := map[string]bool{}
+	for _, f := range pkg.Files {
+		for name, _ := range f.Scope.Objects {
+			scope[name] = true
+		}
+	}
+	for name, _ := range sels {
+		if !ast.IsExported(name) || !scope[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// ImportGroup describes a block of imports.
+// If Prefixes is not empty, the group contains the imports whose path begins with one of the prefixes.
+// Otherwise, a group named `stdlib` contains the standard library imports,
+// and any other group (e.g. `external`) contains all the remaining imports.
+type ImportGroup struct {
+	Name     string   `json:"name"`
+	Prefixes []string `json:"prefixes"`
+}
+
+// importGroupIndex returns the index of the group that importPath belongs to
+func importGroupIndex(groups []ImportGroup, importPath string) int {
+	idx, best := -1, -1
+	for i, g := range groups {
+		for _, pfx := range g.Prefixes {
+			pfx = strings.TrimSuffix(pfx, "/")
+			if (importPath == pfx || strings.HasPrefix(importPath, pfx+"/")) && len(pfx) > best {
+				idx, best = i, len(pfx)
+			}
+		}
+	}
+	if idx >= 0 {
+		return idx
+	}
+
+	std := isStdlibPath(importPath)
+	for i, g := range groups {
+		if len(g.Prefixes) == 0 && (g.Name == "stdlib") == std {
+			return i
+		}
+	}
+	return len(groups) - 1
+}
+
+type importChunk struct {
+	path string
+	name string
+	// src is the spec's source, including its doc and any other comments preceding it
+	src string
+	// doc is the spec's doc comment
+	doc string
+	// spec is the spec's source including its line comment
+	spec string
+}
+
+// importDeclSource helps slicing up the source of import decls
+type importDeclSource struct {
+	fset *token.FileSet
+	src  string
+}
+
+func (ds importDeclSource) offset(p token.Pos) int {
+	return ds.fset.Position(p).Offset
+}
+
+// lineEnd returns the offset after the end of the line containing offset, but not beyond limit
+func (ds importDeclSource) lineEnd(offset, limit int) int {
+	if i := strings.Index(ds.src[offset:], "\n"); i >= 0 {
+		offset += i + 1
+	} else {
+		offset = len(ds.src)
+	}
+	if offset > limit {
+		offset = limit
+	}
+	return offset
+}
+
+// span returns the range of the decl, including its doc comment if includeDoc is true,
+// and the rest of its last line e.g. the line comment and new line
+func (ds importDeclSource) span(gdecl *ast.GenDecl, includeDoc bool) (start, end int) {
+	start = ds.offset(gdecl.Pos())
+	if includeDoc && gdecl.Doc != nil {
+		start = ds.offset(gdecl.Doc.Pos())
+	}
+	end = ds.lineEnd(ds.offset(gdecl.End()), len(ds.src))
+	return
+}
+
+// chunks splits the import decl into a chunk per spec, keeping the comments with the spec that follows them.
+// If docChunk is true, the decl's doc comment is included in the first chunk.
+// Any comments after the last spec are returned in trailing.
+func (ds importDeclSource) chunks(gdecl *ast.GenDecl, docChunk bool) (chunks []importChunk, trailing []string) {
+	doc := ""
+	if docChunk && gdecl.Doc != nil {
+		doc = strings.TrimSpace(ds.src[ds.offset(gdecl.Doc.Pos()):ds.offset(gdecl.TokPos)]) + "\n"
+	}
+
+	pos, limit := ds.offset(gdecl.TokPos)+len("import"), len(ds.src)
+	if gdecl.Lparen.IsValid() {
+		pos, limit = ds.offset(gdecl.Lparen)+1, ds.offset(gdecl.Rparen)
+	}
+	for _, spec := range gdecl.Specs {
+		ispec := spec.(*ast.ImportSpec)
+		start := ds.offset(ispec.Pos())
+		end := ds.lineEnd(ds.offset(ispec.End()), limit)
+		c := importChunk{
+			path: unquote(ispec.Path.Value),
+			src:  doc + strings.TrimSpace(ds.src[pos:end]),
+			doc:  doc,
+			spec: strings.TrimSpace(ds.src[start:end]),
+		}
+		if ispec.Name != nil {
+			c.name = ispec.Name.Name
+		}
+		if ispec.Doc != nil {
+			c.doc = strings.TrimSpace(ds.src[ds.offset(ispec.Doc.Pos()):start]) + "\n"
+		}
+		chunks = append(chunks, c)
+		pos = end
+		doc = ""
+	}
+
+	if gdecl.Lparen.IsValid() {
+		if s := strings.TrimSpace(ds.src[pos:limit]); s != "" {
+			trailing = append(trailing, s)
+		}
+	}
+	return
+}
+
+// groupImports rewrites the (formatted) source src so that all the imports, excluding `import "C"`,
+// are in a single block, split into groups separated by a blank line.
+// Comments attached to the import specs are kept with them.
+func groupImports(src string, groups []ImportGroup, tabIndent bool, tabWidth int) (string, error) {
+	if len(groups) == 0 {
+		return src, nil
+	}
+
+	fset, af, err := parseAstFile("", src, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return src, err
+	}
+
+	ds := importDeclSource{fset, src}
+	type span struct{ start, end int }
+	decls := []span{}
+	groupChunks := make([][]importChunk, len(groups))
+	trailing := []string{}
+	suffix := ""
+	nSpecs := 0
 	for _, decl := range af.Decls {
-		if gdecl, ok := decl.(*ast.GenDecl); ok {
-			if len(gdecl.Specs) == 0 {
-				continue
+		gdecl, ok := decl.(*ast.GenDecl)
+		if !ok || gdecl.Tok != token.IMPORT || declImportsC(gdecl) {
+			continue
+		}
+
+		// the doc of the decls that are merged into the first one goes along with their first spec
+		first := len(decls) == 0
+		docChunk := !first || !gdecl.Lparen.IsValid()
+		sp := span{}
+		sp.start, sp.end = ds.span(gdecl, docChunk)
+		decls = append(decls, sp)
+
+		chunks, trail := ds.chunks(gdecl, docChunk)
+		for _, c := range chunks {
+			i := importGroupIndex(groups, c.path)
+			groupChunks[i] = append(groupChunks[i], c)
+			nSpecs += 1
+		}
+		trailing = append(trailing, trail...)
+
+		// a comment after the closing paren
+		if gdecl.Lparen.IsValid() {
+			if s := strings.TrimSpace(src[ds.offset(gdecl.Rparen)+1 : sp.end]); s != "" {
+				if first {
+					suffix = " " + s
+				} else {
+					trailing = append(trailing, s)
+				}
 			}
 		}
-		af.Decls[dj] = decl
-		dj += 1
 	}
-	af.Decls = af.Decls[:dj]
 
+	if nSpecs < 2 {
+		return src, nil
+	}
+
+	buf := bytes.NewBufferString("import (\n")
+	sep := ""
+	for _, l := range groupChunks {
+		if len(l) == 0 {
+			continue
+		}
+		sort.Sort(importChunks(l))
+		buf.WriteString(sep)
+		for _, c := range l {
+			buf.WriteString(c.src)
+			buf.WriteString("\n")
+		}
+		sep = "\n"
+	}
+	for _, s := range trailing {
+		buf.WriteString(s)
+		buf.WriteString("\n")
+	}
+	buf.WriteString(")" + suffix + "\n")
+
+	s := src
+	for i := len(decls) - 1; i >= 0; i-- {
+		repl := ""
+		if i == 0 {
+			repl = buf.String()
+		}
+		s = s[:decls[i].start] + repl + s[decls[i].end:]
+	}
+
+	fset, af, err = parseAstFile("", s, parser.ParseComments)
+	if err != nil {
+		return src, err
+	}
 	ast.SortImports(fset, af)
-	return af
+	return printSrc(fset, af, tabIndent, tabWidth)
+}
+
+// splitImportC moves `import "C"` out of any import block that contains other imports into its own decl
+// so that its cgo preamble stays attached to it, and the other imports can be edited or sorted safely.
+// The source is returned unchanged if there's nothing to do.
+func splitImportC(src string) string {
+	fset, af, err := parseAstFile("", src, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return src
+	}
+
+	ds := importDeclSource{fset, src}
+	for i := len(af.Decls) - 1; i >= 0; i-- {
+		gdecl, ok := af.Decls[i].(*ast.GenDecl)
+		if !ok || gdecl.Tok != token.IMPORT || len(gdecl.Specs) < 2 || !declImportsC(gdecl) {
+			continue
+		}
+
+		start, end := ds.span(gdecl, false)
+		suffix := strings.TrimSpace(src[ds.offset(gdecl.Rparen)+1 : end])
+		chunks, trailing := ds.chunks(gdecl, false)
+		cgo := ""
+		buf := bytes.NewBufferString("import (\n")
+		for _, c := range chunks {
+			if c.path == "C" {
+				// anything before the preamble stays in the block
+				if pfx := strings.TrimSpace(strings.TrimSuffix(c.src, c.spec)); c.doc != "" {
+					pfx = strings.TrimSpace(strings.TrimSuffix(pfx, strings.TrimSpace(c.doc)))
+					if pfx != "" {
+						trailing = append(trailing, pfx)
+					}
+				}
+				cgo = "\n" + unindentLineComments(c.doc) + "import " + c.spec + "\n"
+			} else {
+				buf.WriteString("\t" + c.src + "\n")
+			}
+		}
+		for _, s := range trailing {
+			buf.WriteString("\t" + s + "\n")
+		}
+		buf.WriteString(")")
+		if suffix != "" {
+			buf.WriteString(" " + suffix)
+		}
+		buf.WriteString("\n")
+		// the block's doc comment is above it so we put the cgo decl after it
+		src = src[:start] + buf.String() + cgo + src[end:]
+	}
+	return src
+}
+
+// unindentLineComments removes the indentation of the lines of s that are line comments
+// e.g. a cgo preamble that's moved out of an import block
+func unindentLineComments(s string) string {
+	l := strings.Split(s, "\n")
+	for i, ln := range l {
+		if t := strings.TrimLeft(ln, " \t"); strings.HasPrefix(t, "//") {
+			l[i] = t
+		}
+	}
+	return strings.Join(l, "\n")
+}
+
+type importChunks []importChunk
+
+func (l importChunks) Len() int {
+	return len(l)
+}
+
+func (l importChunks) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l importChunks) Less(i, j int) bool {
+	if l[i].path != l[j].path {
+		return l[i].path < l[j].path
+	}
+	return l[i].name < l[j].name
+}
+
+func declImportsC(gdecl *ast.GenDecl) bool {
+	for _, spec := range gdecl.Specs {
+		if ispec, ok := spec.(*ast.ImportSpec); ok && unquote(ispec.Path.Value) == "C" {
+			return true
+		}
+	}
+	return false
 }
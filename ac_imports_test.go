@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var importCTests = []struct {
+	name    string
+	src     string
+	split   string
+	imports string
+}{
+	{
+		name: "alone",
+		src: `package p
+
+import "C"
+`,
+		split: `package p
+
+import "C"
+`,
+		imports: `package p
+
+import (
+	"strconv"
+)
+
+import "C"
+`,
+	},
+	{
+		name: "group",
+		src: `package p
+
+import (
+	"C"
+	"os"
+)
+`,
+		split: `package p
+
+import (
+	"os"
+)
+
+import "C"
+`,
+		imports: `package p
+
+import (
+	"strconv"
+)
+
+import "C"
+`,
+	},
+	{
+		name: "preamble",
+		src: `package p
+
+import (
+	"os"
+
+	// #include <stdio.h>
+	// #include <stdlib.h>
+	"C"
+
+	"strings"
+)
+`,
+		split: `package p
+
+import (
+	"os"
+	"strings"
+)
+
+// #include <stdio.h>
+// #include <stdlib.h>
+import "C"
+`,
+		imports: `package p
+
+import (
+	"strconv"
+	"strings"
+)
+
+// #include <stdio.h>
+// #include <stdlib.h>
+import "C"
+`,
+	},
+	{
+		name: "groups",
+		src: `package p
+
+import (
+	"fmt"
+	"os"
+)
+
+import (
+	// #include <stdio.h>
+	"C"
+	"unsafe"
+)
+`,
+		split: `package p
+
+import (
+	"fmt"
+	"os"
+)
+
+import (
+	"unsafe"
+)
+
+// #include <stdio.h>
+import "C"
+`,
+		imports: `package p
+
+import (
+	"fmt"
+	"strconv"
+)
+
+import (
+	"unsafe"
+)
+
+// #include <stdio.h>
+import "C"
+`,
+	},
+}
+
+func TestSplitImportC(t *testing.T) {
+	for _, tt := range importCTests {
+		if got := splitImportC(tt.src); got != tt.split {
+			t.Errorf("%s: splitImportC() = %q, want %q", tt.name, got, tt.split)
+		}
+	}
+}
+
+func TestImportsImportC(t *testing.T) {
+	for _, tt := range importCTests {
+		// the args are sent as a map so the tab_indent and tab_width defaults apply
+		a, _ := json.Marshal(map[string]interface{}{
+			"src": tt.src,
+			"toggle": []ImportDeclArg{
+				{Path: "strconv", Add: true},
+				{Path: "os"},
+			},
+		})
+		req := httptest.NewRequest("POST", "/imports", strings.NewReader(url.Values{"data": {string(a)}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		v, err := actions["/imports"].Func(Request{Rw: httptest.NewRecorder(), Req: req})
+		if err != nil {
+			t.Errorf("%s: /imports failed: %s", tt.name, err)
+			continue
+		}
+		if got := v.(ImportsResult).Src; got != tt.imports {
+			t.Errorf("%s: /imports src = %q, want %q", tt.name, got, tt.imports)
+		}
+	}
+}
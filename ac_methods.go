@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/types"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type MethodsArgs struct {
+	Fn     string            `json:"fn"`
+	Src    string            `json:"src"`
+	Offset int               `json:"offset"`
+	Env    map[string]string `json:"env"`
+}
+
+// MethodsResult lists the method sets of a type. Value is the method set of T and Pointer is that of *T.
+// Interfaces only have a Value method set
+type MethodsResult struct {
+	Name    string         `json:"name"`
+	Pkg     string         `json:"pkg"`
+	Kind    string         `json:"kind"`
+	Fn      string         `json:"fn"`
+	Row     int            `json:"row"`
+	Col     int            `json:"col"`
+	Value   []*MethodGroup `json:"value"`
+	Pointer []*MethodGroup `json:"pointer"`
+}
+
+// MethodGroup is a list of methods declared on the same receiver type. Path is the list of embedded fields
+// the methods are promoted through, it's empty for the type's own methods
+type MethodGroup struct {
+	Recv    string    `json:"recv"`
+	Path    []string  `json:"path"`
+	Methods []*Method `json:"methods"`
+}
+
+// Method is a method in a method set. Decl is its signature, Ptr is true if it has a pointer receiver
+// and Indirect is true if it's reached through a pointer embedded field
+type Method struct {
+	Name     string `json:"name"`
+	Decl     string `json:"decl"`
+	Pkg      string `json:"pkg"`
+	Fn       string `json:"fn"`
+	Row      int    `json:"row"`
+	Col      int    `json:"col"`
+	Ptr      bool   `json:"ptr"`
+	Indirect bool   `json:"indirect"`
+}
+
+func init() {
+	act(Action{
+		Path: "/methods",
+		Doc: `
+lists the method sets of the type of the identifier at offset in the file fn (whose content is src, if set)
+@data: {"fn": "...", "src": "...", "offset": 0, "env": {}}
+@resp: {"name": "", "pkg": "", "kind": "", "fn": "", "row": 0, "col": 0, "value": [], "pointer": []}
+the identifier may name a type, or a variable, constant or field whose type is (a pointer to) the type.
+value is the method set of T and pointer is that of *T, interfaces only have a value method set.
+methods are grouped by the type they're declared on: {"recv": "", "path": [], "methods": []}
+where path lists the embedded fields methods are promoted through, it's empty for the type's own methods.
+methods are: {"name": "", "decl": "", "pkg": "", "fn": "", "row": 0, "col": 0, "ptr": false, "indirect": false}
+ptr is true for methods with a pointer receiver and indirect is true for methods promoted through an embedded pointer
+`,
+		Func: func(r Request) (data, error) {
+			a := MethodsArgs{
+				Env: map[string]string{},
+			}
+			res := &MethodsResult{
+				Value:   []*MethodGroup{},
+				Pointer: []*MethodGroup{},
+			}
+			if err := r.Decode(&a); err != nil {
+				return res, err
+			}
+			if a.Fn == "" {
+				return res, errors.New("fn must be set")
+			}
+			a.Fn, _ = filepath.Abs(a.Fn)
+
+			tc, err := typeCheck(a.Env, a.Fn, a.Src, nil)
+			if err != nil {
+				return res, err
+			}
+
+			typeCheckLck.Lock()
+			defer typeCheckLck.Unlock()
+
+			tobj := typeObjAt(tc, a.Offset)
+			if tobj == nil {
+				return res, errors.New("no identifier at offset")
+			}
+			var typ types.Type
+			switch tobj.(type) {
+			case *types.TypeName, *types.Var, *types.Const:
+				typ = tobj.Type()
+			default:
+				return res, fmt.Errorf("%s is a %s, not a type", tobj.Name(), typeObjKind(tobj))
+			}
+			if p, ok := typ.(*types.Pointer); ok {
+				typ = p.Elem()
+			}
+
+			methodSets(tc, typ, res)
+			return res, nil
+		},
+	})
+}
+
+// methodSets fills res with the method sets of typ
+func methodSets(tc *typeCheckPkg, typ types.Type, res *MethodsResult) {
+	qual := types.RelativeTo(tc.Pkg)
+	res.Name = types.TypeString(typ, qual)
+	res.Kind = typeKind(typ)
+	if named, ok := typ.(*types.Named); ok {
+		obj := named.Obj()
+		res.Name = obj.Name()
+		if obj.Pkg() != nil {
+			res.Pkg = obj.Pkg().Path()
+			qual = types.RelativeTo(obj.Pkg())
+		}
+		if obj.Pos().IsValid() {
+			tp := tc.Fset.Position(obj.Pos())
+			res.Fn = tp.Filename
+			res.Row = tp.Line - 1
+			res.Col = tp.Column - 1
+		}
+	}
+
+	res.Value = methodGroups(tc, typ, types.NewMethodSet(typ), qual)
+	if !types.IsInterface(typ) {
+		res.Pointer = methodGroups(tc, typ, types.NewMethodSet(types.NewPointer(typ)), qual)
+	}
+}
+
+// methodGroups groups the methods in mset, the method set of typ or *typ, by the type they're declared on
+func methodGroups(tc *typeCheckPkg, typ types.Type, mset *types.MethodSet, qual types.Qualifier) []*MethodGroup {
+	groups := []*MethodGroup{}
+	for i := 0; i < mset.Len(); i += 1 {
+		sel := mset.At(i)
+		fn, ok := sel.Obj().(*types.Func)
+		if !ok {
+			continue
+		}
+		sig := fn.Type().(*types.Signature)
+
+		recv := ""
+		ptr := false
+		if sig.Recv() != nil {
+			rt := sig.Recv().Type()
+			if p, ok := rt.(*types.Pointer); ok {
+				ptr = true
+				rt = p.Elem()
+			}
+			recv = types.TypeString(rt, qual)
+			if ptr {
+				recv = "*" + recv
+			}
+		}
+		path, indirect := embeddedPath(typ, sel.Index())
+
+		var g *MethodGroup
+		for _, v := range groups {
+			if v.Recv == recv && strings.Join(v.Path, ".") == strings.Join(path, ".") {
+				g = v
+				break
+			}
+		}
+		if g == nil {
+			g = &MethodGroup{
+				Recv:    recv,
+				Path:    path,
+				Methods: []*Method{},
+			}
+			groups = append(groups, g)
+		}
+
+		m := &Method{
+			Name:     fn.Name(),
+			Decl:     methodDecl(fn, sig, qual),
+			Ptr:      ptr,
+			Indirect: indirect,
+		}
+		if fn.Pkg() != nil {
+			m.Pkg = fn.Pkg().Path()
+		}
+		if fn.Pos().IsValid() {
+			tp := tc.Fset.Position(fn.Pos())
+			m.Fn = tp.Filename
+			m.Row = tp.Line - 1
+			m.Col = tp.Column - 1
+		}
+		g.Methods = append(g.Methods, m)
+	}
+	sort.Stable(methodGroupList(groups))
+	return groups
+}
+
+// embeddedPath returns the names of the embedded fields followed by index, the index of a method of typ,
+// and whether any of them is a pointer
+func embeddedPath(typ types.Type, index []int) (path []string, indirect bool) {
+	path = []string{}
+	for _, i := range index[:len(index)-1] {
+		if p, ok := typ.(*types.Pointer); ok {
+			typ = p.Elem()
+		}
+		st, ok := typ.Underlying().(*types.Struct)
+		if !ok || i >= st.NumFields() {
+			break
+		}
+		f := st.Field(i)
+		path = append(path, f.Name())
+		typ = f.Type()
+		if _, ok := typ.(*types.Pointer); ok {
+			indirect = true
+		}
+	}
+	return path, indirect
+}
+
+// methodDecl returns the signature of the method fn as it's declared e.g. func (t *T) M(x int) error
+func methodDecl(fn *types.Func, sig *types.Signature, qual types.Qualifier) string {
+	s := strings.TrimPrefix(types.TypeString(sig, qual), "func")
+	if sig.Recv() == nil {
+		return "func " + fn.Name() + s
+	}
+	recv := types.TypeString(sig.Recv().Type(), qual)
+	if name := sig.Recv().Name(); name != "" && name != "_" {
+		recv = name + " " + recv
+	}
+	return "func (" + recv + ") " + fn.Name() + s
+}
+
+// typeKind returns the kind of type typ is e.g. struct or interface, basic types are named e.g. int
+func typeKind(typ types.Type) string {
+	switch v := typ.Underlying().(type) {
+	case *types.Basic:
+		return v.Name()
+	case *types.Struct:
+		return "struct"
+	case *types.Interface:
+		return "interface"
+	case *types.Pointer:
+		return "pointer"
+	case *types.Slice:
+		return "slice"
+	case *types.Array:
+		return "array"
+	case *types.Map:
+		return "map"
+	case *types.Chan:
+		return "chan"
+	case *types.Signature:
+		return "func"
+	}
+	return "bad"
+}
+
+// methodGroupList sorts the type's own methods first, followed by promoted methods ordered by the depth of
+// their embedding. The order of groups at the same depth is unchanged
+type methodGroupList []*MethodGroup
+
+func (l methodGroupList) Len() int {
+	return len(l)
+}
+
+func (l methodGroupList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l methodGroupList) Less(i, j int) bool {
+	return len(l[i].Path) < len(l[j].Path)
+}
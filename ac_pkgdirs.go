@@ -1,26 +1,72 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
-)
-
-var (
-	pkgDirsLck   = sync.RWMutex{}
-	pkgDirsCache = map[string]bool{}
+	"time"
 )
 
 type PkgDirsArgs struct {
-	Env map[string]string `json:"env"`
+	Env         map[string]string `json:"env"`
+	Synopsis    bool              `json:"synopsis"`
+	Concurrency int               `json:"concurrency"`
+	MaxDepth    int               `json:"max_depth"`
+	Ignore      []string          `json:"ignore"`
+	Roots       []string          `json:"roots"`
+	Prefix      string            `json:"prefix"`
+	Query       string            `json:"query"`
+	Cursor      string            `json:"cursor"`
+	Limit       int               `json:"limit"`
+}
+
+type PkgDirsResult struct {
+	Dirs   []*PkgDirInfo `json:"dirs"`
+	Cursor string        `json:"cursor"`
+}
+
+// PkgDirInfo describes a package dir. Kind is `cmd` if the package is named main, `lib` if it's any other package
+// or empty if the dir doesn't contain a buildable package e.g. it only contains tests
+type PkgDirInfo struct {
+	Root     string   `json:"root,omitempty"`
+	Path     string   `json:"path,omitempty"`
+	Fn       string   `json:"fn"`
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`
+	Synopsis string   `json:"synopsis"`
+	Ranges   [][2]int `json:"ranges,omitempty"`
+
+	score int
 }
 
 func init() {
 	act(Action{
 		Path: "/pkgdirs",
-		Doc:  ``,
+		Doc: `
+lists the package dirs in each of GOROOT and GOPATH
+@data: {"env": {}, "synopsis": false, "concurrency": 0, "max_depth": 0, "ignore": ["*_data", "third_party/*"]}
+@resp: {"/root/dir": {"import/path": "/root/dir/import/path/file.go"}}
+testdata, vendor, node_modules and VCS dirs are skipped, as are dirs whose name or path relative to the root dir matches any of the ignore globs.
+max_depth limits how deep below the root dir the walk goes and concurrency limits the number of dirs read in parallel, 0 means the default.
+if synopsis is true, each entry is instead an object containing the package name, its kind (cmd or lib) and the first sentence of its documentation.
+the kind is only reported in this form and in the paged list below, the default form only maps import paths to files
+@resp: {"/root/dir": {"import/path": {"fn": "...", "name": "path", "kind": "lib", "synopsis": "..."}}}
+
+if any of roots, prefix, query, cursor or limit is set, a flat, paged list is returned instead
+@data: {"env": {}, "roots": ["/root/dir"], "prefix": "net/", "query": "", "cursor": "", "limit": 100}
+@resp: {"dirs": [{"root": "/root/dir", "path": "net/http", "fn": "...", "name": "http", "kind": "lib", "synopsis": "", "ranges": [[0, 1]]}], "cursor": "..."}
+roots restricts the list to those root dirs, prefix to import paths starting with it and query to import paths that fuzzily match it.
+entries are sorted by root dir then import path, or best match first if query is set, and ranges are the byte ranges of the path that matched.
+at most limit entries are returned (default 100). if there are more, cursor is set and may be passed back to fetch the next page,
+which starts after the last entry of this one, so dirs added or removed in between don't cause other entries to be skipped or repeated
+`,
 		Func: func(r Request) (data, error) {
 			a := PkgDirsArgs{
 				Env: map[string]string{},
@@ -29,68 +75,428 @@ func init() {
 				return map[string]map[string]string{}, err
 			}
 
-			return pkgDirs(a.Env), nil
+			opts := defaultWalkOptions()
+			if a.Concurrency > 0 {
+				opts.Concurrency = a.Concurrency
+			}
+			opts.MaxDepth = a.MaxDepth
+			opts.Ignore = a.Ignore
+
+			if len(a.Roots) != 0 || a.Prefix != "" || a.Query != "" || a.Cursor != "" || a.Limit != 0 {
+				return pkgDirsPage(a, opts)
+			}
+
+			dirs := pkgDirsWith(a.Env, opts)
+			if !a.Synopsis {
+				return dirs, nil
+			}
+
+			res := map[string]map[string]*PkgDirInfo{}
+			for root, m := range dirs {
+				res[root] = map[string]*PkgDirInfo{}
+				for importPath, fn := range m {
+					res[root][importPath] = newPkgDirInfo("", "", fn, true)
+				}
+			}
+			return res, nil
 		},
 	})
 }
 
+func newPkgDirInfo(root, importPath, fn string, synopsis bool) *PkgDirInfo {
+	dir := filepath.Dir(fn)
+	p := &PkgDirInfo{
+		Root: root,
+		Path: importPath,
+		Fn:   fn,
+		Name: pkgDirName(dir),
+	}
+	switch p.Name {
+	case "":
+	case "main":
+		p.Kind = "cmd"
+	default:
+		p.Kind = "lib"
+	}
+	if synopsis {
+		p.Synopsis = pkgDirSynopsis(dir)
+	}
+	return p
+}
+
+func pkgDirsPage(a PkgDirsArgs, opts walkOptions) (PkgDirsResult, error) {
+	res := PkgDirsResult{
+		Dirs: []*PkgDirInfo{},
+	}
+
+	var cursor *pkgDirsCursor
+	if a.Cursor != "" {
+		s, err := base64.URLEncoding.DecodeString(a.Cursor)
+		if err == nil {
+			err = json.Unmarshal(s, &cursor)
+		}
+		if err != nil || cursor == nil {
+			return res, fmt.Errorf("invalid cursor: %q", a.Cursor)
+		}
+	}
+	limit := a.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	roots := rootDirs(a.Env)
+	if len(a.Roots) != 0 {
+		want := map[string]bool{}
+		for _, root := range a.Roots {
+			want[filepath.Clean(root)] = true
+		}
+		l := []string{}
+		for _, root := range roots {
+			if want[filepath.Clean(root)] {
+				l = append(l, root)
+			}
+		}
+		roots = l
+	}
+
+	l := []*PkgDirInfo{}
+	for _, root := range roots {
+		for importPath, fn := range walkRootDir(root, opts) {
+			if !strings.HasPrefix(importPath, a.Prefix) {
+				continue
+			}
+			p := &PkgDirInfo{
+				Root: root,
+				Path: importPath,
+				Fn:   fn,
+			}
+			if a.Query != "" {
+				score, ranges, ok := fuzzyMatch(a.Query, importPath)
+				if !ok {
+					continue
+				}
+				p.score = score
+				p.Ranges = ranges
+			}
+			l = append(l, p)
+		}
+	}
+
+	rootIndex := map[string]int{}
+	for i, root := range roots {
+		rootIndex[root] = i
+	}
+	d := pkgDirInfos{l, rootIndex}
+	sort.Sort(d)
+
+	// the dirs are walked again for each page, so the page starts after the last entry of the previous one
+	// instead of at an offset that may have moved if dirs were added or removed in the meantime
+	offset := 0
+	if cursor != nil {
+		last := &PkgDirInfo{
+			Root:  cursor.Root,
+			Path:  cursor.Path,
+			score: cursor.Score,
+		}
+		if _, ok := rootIndex[last.Root]; !ok {
+			return res, fmt.Errorf("invalid cursor: %q", a.Cursor)
+		}
+		offset = sort.Search(len(l), func(i int) bool {
+			return d.less(last, l[i])
+		})
+	}
+	end := offset + limit
+	if end < len(l) {
+		last := l[end-1]
+		s, _ := json.Marshal(pkgDirsCursor{
+			Root:  last.Root,
+			Path:  last.Path,
+			Score: last.score,
+		})
+		res.Cursor = base64.URLEncoding.EncodeToString(s)
+	} else {
+		end = len(l)
+	}
+
+	// only the entries on this page are inspected
+	for _, p := range l[offset:end] {
+		q := newPkgDirInfo(p.Root, p.Path, p.Fn, a.Synopsis)
+		q.Ranges = p.Ranges
+		res.Dirs = append(res.Dirs, q)
+	}
+	return res, nil
+}
+
+// pkgDirsCursor is the last entry of a page of /pkgdirs
+type pkgDirsCursor struct {
+	Root  string `json:"root"`
+	Path  string `json:"path"`
+	Score int    `json:"score"`
+}
+
+type pkgDirInfos struct {
+	l         []*PkgDirInfo
+	rootIndex map[string]int
+}
+
+func (d pkgDirInfos) Len() int {
+	return len(d.l)
+}
+
+func (d pkgDirInfos) Swap(i, j int) {
+	d.l[i], d.l[j] = d.l[j], d.l[i]
+}
+
+func (d pkgDirInfos) Less(i, j int) bool {
+	return d.less(d.l[i], d.l[j])
+}
+
+func (d pkgDirInfos) less(p, q *PkgDirInfo) bool {
+	if p.score != q.score {
+		return p.score > q.score
+	}
+	if a, b := d.rootIndex[p.Root], d.rootIndex[q.Root]; a != b {
+		return a < b
+	}
+	if len(p.Path) != len(q.Path) && p.score != 0 {
+		return len(p.Path) < len(q.Path)
+	}
+	return p.Path < q.Path
+}
+
 func pkgDirs(env map[string]string) map[string]map[string]string {
+	return pkgDirsWith(env, defaultWalkOptions())
+}
+
+func pkgDirsWith(env map[string]string, opts walkOptions) map[string]map[string]string {
 	res := map[string]map[string]string{}
 	for _, root := range rootDirs(env) {
-		res[root] = map[string]string{}
-		walkRootDir(root, res[root], root)
+		res[root] = walkRootDir(root, opts)
 	}
 	return res
 }
 
-func walkRootDir(root string, m map[string]string, basePath string) {
-	dir, err := os.Open(root)
+// walkOptions controls which dirs are visited by walkRootDir
+type walkOptions struct {
+	// the maximum number of dirs read at the same time
+	Concurrency int
+	// the maximum depth of dirs below the root that are visited, unlimited if <= 0
+	MaxDepth int
+	// the names of dirs that are never visited. dirs whose name start with `.` or `_` are always skipped
+	Skip map[string]bool
+	// dirs whose base name or slash-separated path relative to the root match any of these patterns are skipped
+	Ignore []string
+}
+
+func defaultWalkOptions() walkOptions {
+	return walkOptions{
+		Concurrency: runtime.NumCPU() * 2,
+		Skip: map[string]bool{
+			"testdata":     true,
+			"vendor":       true,
+			"node_modules": true,
+			".git":         true,
+			".hg":          true,
+			".svn":         true,
+			".bzr":         true,
+			"CVS":          true,
+		},
+	}
+}
+
+// key identifies the result of walking root with these options
+func (o walkOptions) key(root string) string {
+	skip := []string{}
+	for name, _ := range o.Skip {
+		skip = append(skip, name)
+	}
+	sort.Strings(skip)
+	return fmt.Sprintf("%s\x00%d\x00%q\x00%q", root, o.MaxDepth, skip, o.Ignore)
+}
+
+func (o walkOptions) skipDir(name, importPath string, depth int) bool {
+	if name[0] == '.' || name[0] == '_' || o.Skip[name] {
+		return true
+	}
+	if o.MaxDepth > 0 && depth > o.MaxDepth {
+		return true
+	}
+	for _, pat := range o.Ignore {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pat, importPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// walkRootDir returns a map of the import paths of the package dirs in root to the path of a .go file in that dir.
+// The file is preferably named after the package dir, or failing that, main.go.
+// Dirs are read in parallel, and symlinks are followed unless they lead back to a dir that's already being walked.
+// The result is cached until any of the dirs that were walked is modified
+func walkRootDir(root string, opts walkOptions) map[string]string {
+	fi, err := os.Stat(root)
+	if err != nil || !fi.IsDir() {
+		return map[string]string{}
+	}
+	real, err := filepath.EvalSymlinks(root)
 	if err != nil {
-		return
+		return map[string]string{}
+	}
+
+	key := opts.key(root)
+	walkCacheLck.Lock()
+	ent := walkCache[key]
+	walkCacheLck.Unlock()
+	if ent == nil || !ent.fresh() {
+		w := &dirWalker{
+			opts: opts,
+			root: root,
+			m:    map[string]string{},
+			dirs: map[string]time.Time{},
+		}
+		if opts.Concurrency > 1 {
+			w.sem = make(chan struct{}, opts.Concurrency-1)
+		}
+		w.walk(root, ".", 0, []string{real}, fi.ModTime())
+		w.wg.Wait()
+
+		ent = &walkCacheEnt{
+			dirs: w.dirs,
+			m:    w.m,
+		}
+		walkCacheLck.Lock()
+		walkCache[key] = ent
+		walkCacheLck.Unlock()
+	}
+
+	m := make(map[string]string, len(ent.m))
+	for k, v := range ent.m {
+		m[k] = v
+	}
+	return m
+}
+
+var (
+	walkCacheLck = sync.Mutex{}
+	walkCache    = map[string]*walkCacheEnt{}
+)
+
+// walkCacheEnt is the result of walking a root dir. dirs holds the modification time of each dir that was read
+type walkCacheEnt struct {
+	dirs map[string]time.Time
+	m    map[string]string
+}
+
+// fresh reports whether none of the dirs have been modified i.e. no files or dirs were added, removed or renamed
+func (ent *walkCacheEnt) fresh() bool {
+	for dir, modTime := range ent.dirs {
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.ModTime().Equal(modTime) {
+			return false
+		}
 	}
-	defer dir.Close()
+	return true
+}
 
-	importPath, err := filepath.Rel(basePath, root)
+type dirWalker struct {
+	opts walkOptions
+	root string
+	sem  chan struct{}
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	m    map[string]string
+	dirs map[string]time.Time
+}
+
+// walk reads the dir fn whose import path is importPath and whose modification time is modTime.
+// parents is the list of dirs from the root down to fn, with symlinks resolved. Only the entries that are symlinks
+// are stat'ed, to find out what they lead to, and dirs, to find out when they're modified
+func (w *dirWalker) walk(fn, importPath string, depth int, parents []string, modTime time.Time) {
+	w.mu.Lock()
+	w.dirs[fn] = modTime
+	w.mu.Unlock()
+
+	l, err := os.ReadDir(fn)
 	if err != nil {
-		importPath = root
+		return
 	}
-	importPath = path.Clean(filepath.ToSlash(importPath))
+
+	real := parents[len(parents)-1]
 	idealName := path.Base(importPath) + ".go"
+	goFn := ""
+	for _, de := range l {
+		name := de.Name()
+		isDir := de.IsDir()
+		subReal := filepath.Join(real, name)
+		var fi os.FileInfo
+		if de.Type()&os.ModeSymlink != 0 {
+			fi, err = os.Stat(filepath.Join(fn, name))
+			if err != nil || !(fi.IsDir() || fi.Mode().IsRegular()) {
+				continue
+			}
+			isDir = fi.IsDir()
+			if isDir {
+				if subReal, err = filepath.EvalSymlinks(filepath.Join(fn, name)); err != nil {
+					continue
+				}
+			}
+		}
 
-	names, err := dir.Readdirnames(-1)
-	for _, name := range names {
-		if name[0] == '.' || name[0] == '_' {
+		if !isDir {
+			if strings.HasSuffix(name, ".go") && name[0] != '.' && name[0] != '_' {
+				isIdeal := strings.HasSuffix(goFn, idealName)
+				if goFn == "" || name == idealName || (!isIdeal && name == "main.go") {
+					goFn = filepath.Join(fn, name)
+				}
+			}
 			continue
 		}
 
-		fn := filepath.Join(root, name)
-		if strings.HasSuffix(name, ".go") {
-			isIdeal := false
-			oldFn, ok := m[importPath]
-			if ok {
-				isIdeal = strings.HasSuffix(oldFn, idealName)
-			}
-			if !ok || name == idealName || (!isIdeal && name == "main.go") {
-				m[importPath] = fn
+		subPath := path.Join(importPath, name)
+		if w.opts.skipDir(name, subPath, depth+1) {
+			continue
+		}
+
+		cycle := false
+		for _, p := range parents {
+			if p == subReal {
+				cycle = true
+				break
 			}
-		} else {
-			pkgDirsLck.RLock()
-			isDir, ok := pkgDirsCache[fn]
-			pkgDirsLck.RUnlock()
-
-			if ok {
-				if isDir {
-					walkRootDir(fn, m, basePath)
-				}
-			} else if fi, err := os.Stat(fn); err == nil {
-				pkgDirsLck.Lock()
-				pkgDirsCache[fn] = fi.IsDir()
-				pkgDirsLck.Unlock()
+		}
+		if cycle {
+			continue
+		}
 
-				if fi.IsDir() {
-					walkRootDir(fn, m, basePath)
-				}
+		if fi == nil {
+			if fi, err = de.Info(); err != nil {
+				continue
 			}
 		}
+		subFn := filepath.Join(fn, name)
+		subParents := make([]string, len(parents), len(parents)+1)
+		copy(subParents, parents)
+		subParents = append(subParents, subReal)
+
+		select {
+		case w.sem <- struct{}{}:
+			w.wg.Add(1)
+			go func(subFn, subPath string, modTime time.Time) {
+				defer w.wg.Done()
+				w.walk(subFn, subPath, depth+1, subParents, modTime)
+				<-w.sem
+			}(subFn, subPath, fi.ModTime())
+		default:
+			w.walk(subFn, subPath, depth+1, subParents, fi.ModTime())
+		}
+	}
+
+	if goFn != "" {
+		w.mu.Lock()
+		w.m[importPath] = goFn
+		w.mu.Unlock()
 	}
 }
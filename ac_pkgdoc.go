@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/doc"
+	"go/doc/comment"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"html"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type PkgDocArgs struct {
+	Path      string            `json:"path"`
+	Fn        string            `json:"fn"`
+	Env       map[string]string `json:"env"`
+	All       bool              `json:"all"`
+	Html      bool              `json:"html"`
+	LinkBase  string            `json:"link_base"`
+	TabIndent bool              `json:"tab_indent"`
+	TabWidth  int               `json:"tab_width"`
+}
+
+// PkgDoc is the documentation of a package, as shown by godoc.
+// Examples are the package's own examples, the others are attached to the func, type or method they're for
+type PkgDoc struct {
+	ImportPath string           `json:"import_path"`
+	Name       string           `json:"name"`
+	Dir        string           `json:"dir"`
+	Synopsis   string           `json:"synopsis"`
+	Doc        string           `json:"doc"`
+	Filenames  []string         `json:"filenames"`
+	Consts     []*PkgDocValue   `json:"consts"`
+	Vars       []*PkgDocValue   `json:"vars"`
+	Funcs      []*PkgDocFunc    `json:"funcs"`
+	Types      []*PkgDocType    `json:"types"`
+	Examples   []*PkgDocExample `json:"examples"`
+	Bugs       []string         `json:"bugs"`
+	Html       string           `json:"html,omitempty"`
+
+	// the imports of each file, by name
+	imports map[string]map[string]string
+}
+
+// PkgDocValue is a const or var declaration, it may declare more than one name
+type PkgDocValue struct {
+	Names []string `json:"names"`
+	Decl  string   `json:"decl"`
+	Doc   string   `json:"doc"`
+	Fn    string   `json:"fn"`
+	Row   int      `json:"row"`
+	Col   int      `json:"col"`
+}
+
+type PkgDocFunc struct {
+	Name     string           `json:"name"`
+	Recv     string           `json:"recv"`
+	Decl     string           `json:"decl"`
+	Doc      string           `json:"doc"`
+	Fn       string           `json:"fn"`
+	Row      int              `json:"row"`
+	Col      int              `json:"col"`
+	Examples []*PkgDocExample `json:"examples"`
+}
+
+// PkgDocType is a type declaration. Consts, Vars and Funcs are those associated with the type
+// i.e. typed constants and variables, and constructors
+type PkgDocType struct {
+	Name     string           `json:"name"`
+	Decl     string           `json:"decl"`
+	Doc      string           `json:"doc"`
+	Fn       string           `json:"fn"`
+	Row      int              `json:"row"`
+	Col      int              `json:"col"`
+	Consts   []*PkgDocValue   `json:"consts"`
+	Vars     []*PkgDocValue   `json:"vars"`
+	Funcs    []*PkgDocFunc    `json:"funcs"`
+	Methods  []*PkgDocFunc    `json:"methods"`
+	Examples []*PkgDocExample `json:"examples"`
+}
+
+// PkgDocExample is an example function. Code is its body, or the whole file for whole-file examples,
+// without the output comment
+type PkgDocExample struct {
+	Name        string `json:"name"`
+	Suffix      string `json:"suffix"`
+	Doc         string `json:"doc"`
+	Code        string `json:"code"`
+	Output      string `json:"output"`
+	Unordered   bool   `json:"unordered"`
+	EmptyOutput bool   `json:"empty_output"`
+}
+
+var (
+	outputCommentPat = regexp.MustCompile(`(?i)^\s*//\s*(unordered\s+)?output:`)
+)
+
+func init() {
+	act(Action{
+		Path: "/pkgdoc",
+		Doc: `
+builds the documentation page of the package with import path (or in the dir) path, from its source
+@data: {"path": "...", "fn": "", "env": {}, "all": false, "html": false, "link_base": "", "tab_indent": true, "tab_width": 8}
+@resp: {"import_path": "", "name": "", "dir": "", "synopsis": "", "doc": "", "filenames": [], "consts": [], "vars": [], "funcs": [], "types": [], "examples": [], "bugs": [], "html": ""}
+import paths are resolved relative to the dir of the file fn, if set, so vendored and module packages are found.
+path is only taken to be a dir if it's absolute or starts with ./ or ../, in which case it's relative to the dir of fn, if set.
+consts and vars are: {"names": [], "decl": "", "doc": "", "fn": "", "row": 0, "col": 0}
+funcs and methods are: {"name": "", "recv": "", "decl": "", "doc": "", "fn": "", "row": 0, "col": 0, "examples": []}
+types are: {"name": "", "decl": "", "doc": "", "fn": "", "row": 0, "col": 0, "consts": [], "vars": [], "funcs": [], "methods": [], "examples": []}
+examples are: {"name": "", "suffix": "", "doc": "", "code": "", "output": "", "unordered": false, "empty_output": false}
+if all is true, unexported declarations are included.
+if html is true, html is the page rendered as an html fragment. doc links are prefixed by link_base e.g. https://pkg.go.dev,
+which defaults (if empty) to the path under which MarGo serves package documentation (see -godoc) or https://pkg.go.dev if it's disabled
+`,
+		Func: func(r Request) (data, error) {
+			a := PkgDocArgs{
+				Env: map[string]string{},
+			}
+			if err := r.Decode(&a); err != nil {
+				return &PkgDoc{}, err
+			}
+			if a.LinkBase == "" {
+				a.LinkBase = "https://pkg.go.dev"
+				if acGodoc != nil {
+					a.LinkBase = strings.TrimSuffix(acGodoc.prefix, "/")
+				}
+			}
+
+			srcDir := ""
+			if a.Fn != "" {
+				fn, _ := filepath.Abs(a.Fn)
+				srcDir = filepath.Dir(fn)
+			}
+			pkg, pd, err := pkgDoc(a.Env, a.Path, srcDir, a.All, a.TabIndent, a.TabWidth)
+			if err != nil {
+				return pd, err
+			}
+			if a.Html {
+				pd.Html = pkgDocHTML(pkg, pd, pkgDocLinks{
+					Pkg: func(p string) string {
+						return a.LinkBase + "/" + p
+					},
+				})
+			}
+			return pd, nil
+		},
+	})
+}
+
+// pkgDocDir returns the dir of the package with the import path (or in the dir) p, resolved relative to srcDir.
+// p is only taken to be a dir if it's absolute or starts with ./ or ../, so a dir that happens to be named
+// like an import path doesn't hide the package. If srcDir is empty, the current dir is used
+func pkgDocDir(env map[string]string, p, srcDir string) (string, error) {
+	if p == "" {
+		return "", errors.New("path must be set")
+	}
+	if srcDir == "" {
+		srcDir, _ = os.Getwd()
+	}
+	if filepath.IsAbs(p) || build.IsLocalImport(p) {
+		dir := p
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(srcDir, dir)
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return "", fmt.Errorf("cannot find package dir %s", p)
+		}
+		return filepath.Clean(dir), nil
+	}
+	bp, err := ctxImport(buildContext(env, nil), p, srcDir, build.FindOnly)
+	if bp == nil || bp.Dir == "" {
+		if err == nil {
+			err = fmt.Errorf("cannot find package %s", p)
+		}
+		return "", err
+	}
+	return bp.Dir, nil
+}
+
+// pkgDoc builds the documentation of the package with import path (or in the dir) p, resolved relative to srcDir.
+// The go/doc package is returned along with the result so that it may be rendered
+func pkgDoc(env map[string]string, p, srcDir string, all, tabIndent bool, tabWidth int) (*doc.Package, *PkgDoc, error) {
+	pd := &PkgDoc{
+		Filenames: []string{},
+		Consts:    []*PkgDocValue{},
+		Vars:      []*PkgDocValue{},
+		Funcs:     []*PkgDocFunc{},
+		Types:     []*PkgDocType{},
+		Examples:  []*PkgDocExample{},
+		Bugs:      []string{},
+		imports:   map[string]map[string]string{},
+	}
+
+	dir, err := pkgDocDir(env, p, srcDir)
+	if err != nil {
+		return nil, pd, err
+	}
+	ctx := buildContext(env, nil)
+	bp, err := ctx.ImportDir(dir, 0)
+	if bp == nil || bp.Name == "" {
+		if err == nil {
+			err = fmt.Errorf("no buildable Go source files in %s", dir)
+		}
+		return nil, pd, err
+	}
+
+	fset := token.NewFileSet()
+	files := []*ast.File{}
+	for _, names := range [][]string{bp.GoFiles, bp.CgoFiles, bp.TestGoFiles, bp.XTestGoFiles} {
+		for _, name := range names {
+			af, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.ParseComments)
+			if af == nil {
+				return nil, pd, err
+			}
+			files = append(files, af)
+
+			m := map[string]string{}
+			for _, ispec := range af.Imports {
+				m[specName(ispec)] = unquote(ispec.Path.Value)
+			}
+			pd.imports[fset.Position(af.Pos()).Filename] = m
+		}
+	}
+
+	importPath := dirImportPath(ctx, dir)
+	if importPath == "" {
+		importPath = bp.Name
+	}
+	mode := doc.Mode(0)
+	if all {
+		mode |= doc.AllDecls | doc.AllMethods
+	}
+	pkg, err := doc.NewFromFiles(fset, files, importPath, mode)
+	if err != nil {
+		return nil, pd, err
+	}
+
+	pd.ImportPath = pkg.ImportPath
+	pd.Name = pkg.Name
+	pd.Dir = dir
+	pd.Synopsis = pkg.Synopsis(pkg.Doc)
+	pd.Doc = pkg.Doc
+	for _, name := range pkg.Filenames {
+		// test files are only included for their examples
+		if !strings.HasSuffix(name, "_test.go") {
+			pd.Filenames = append(pd.Filenames, name)
+		}
+	}
+
+	pdv := func(l []*doc.Value) []*PkgDocValue {
+		vl := []*PkgDocValue{}
+		for _, v := range l {
+			gd := *v.Decl
+			gd.Doc = nil
+			decl, _ := printSrc(fset, &gd, tabIndent, tabWidth)
+			tp := fset.Position(v.Decl.Pos())
+			vl = append(vl, &PkgDocValue{
+				Names: v.Names,
+				Decl:  decl,
+				Doc:   v.Doc,
+				Fn:    tp.Filename,
+				Row:   tp.Line - 1,
+				Col:   tp.Column - 1,
+			})
+		}
+		return vl
+	}
+	pdf := func(l []*doc.Func) []*PkgDocFunc {
+		fl := []*PkgDocFunc{}
+		for _, f := range l {
+			fd := *f.Decl
+			fd.Doc, fd.Body = nil, nil
+			decl, _ := printSrc(fset, &fd, tabIndent, tabWidth)
+			tp := fset.Position(f.Decl.Pos())
+			fl = append(fl, &PkgDocFunc{
+				Name:     f.Name,
+				Recv:     f.Recv,
+				Decl:     decl,
+				Doc:      f.Doc,
+				Fn:       tp.Filename,
+				Row:      tp.Line - 1,
+				Col:      tp.Column - 1,
+				Examples: pkgDocExamples(fset, f.Examples, tabIndent, tabWidth),
+			})
+		}
+		return fl
+	}
+
+	pd.Consts = pdv(pkg.Consts)
+	pd.Vars = pdv(pkg.Vars)
+	pd.Funcs = pdf(pkg.Funcs)
+	for _, t := range pkg.Types {
+		gd := *t.Decl
+		gd.Doc = nil
+		decl, _ := printSrc(fset, &gd, tabIndent, tabWidth)
+		tp := fset.Position(t.Decl.Pos())
+		pd.Types = append(pd.Types, &PkgDocType{
+			Name:     t.Name,
+			Decl:     decl,
+			Doc:      t.Doc,
+			Fn:       tp.Filename,
+			Row:      tp.Line - 1,
+			Col:      tp.Column - 1,
+			Consts:   pdv(t.Consts),
+			Vars:     pdv(t.Vars),
+			Funcs:    pdf(t.Funcs),
+			Methods:  pdf(t.Methods),
+			Examples: pkgDocExamples(fset, t.Examples, tabIndent, tabWidth),
+		})
+	}
+	pd.Examples = pkgDocExamples(fset, pkg.Examples, tabIndent, tabWidth)
+	for _, n := range pkg.Notes["BUG"] {
+		pd.Bugs = append(pd.Bugs, n.Body)
+	}
+
+	return pkg, pd, nil
+}
+
+func pkgDocExamples(fset *token.FileSet, l []*doc.Example, tabIndent bool, tabWidth int) []*PkgDocExample {
+	el := []*PkgDocExample{}
+	for _, ex := range l {
+		el = append(el, &PkgDocExample{
+			Name:        ex.Name,
+			Suffix:      ex.Suffix,
+			Doc:         ex.Doc,
+			Code:        exampleCode(fset, ex, tabIndent, tabWidth),
+			Output:      ex.Output,
+			Unordered:   ex.Unordered,
+			EmptyOutput: ex.EmptyOutput,
+		})
+	}
+	return el
+}
+
+// exampleCode returns the source of the example's code, without the braces around
+// the function body (which is unindented) or the output comment
+func exampleCode(fset *token.FileSet, ex *doc.Example, tabIndent bool, tabWidth int) string {
+	buf := &bytes.Buffer{}
+	node := &printer.CommentedNode{Node: ex.Code, Comments: ex.Comments}
+	if err := newPrinter(tabIndent, tabWidth).Fprint(buf, fset, node); err != nil {
+		return ""
+	}
+	s := buf.String()
+	if _, ok := ex.Code.(*ast.BlockStmt); !ok {
+		return s
+	}
+
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "{")
+	s = strings.TrimSuffix(s, "}")
+	lines := strings.Split(strings.Trim(s, "\n"), "\n")
+	// the body is indented by one level, whatever the printer settings
+	indent := ""
+	found := false
+	for _, ln := range lines {
+		if strings.TrimSpace(ln) == "" {
+			continue
+		}
+		prefix := ln[:len(ln)-len(strings.TrimLeft(ln, " \t"))]
+		if !found || len(prefix) < len(indent) {
+			indent = prefix
+			found = true
+		}
+	}
+	for i, ln := range lines {
+		lines[i] = strings.TrimPrefix(ln, indent)
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		if outputCommentPat.MatchString(lines[i]) {
+			lines = lines[:i]
+			break
+		}
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n \t") + "\n"
+}
+
+// pkgDocLinks builds the urls linked to by a rendered package page
+type pkgDocLinks struct {
+	// Pkg returns the url of the page of the package with import path p
+	Pkg func(p string) string
+	// Src returns the url of line row (zero-based) of the file fn, or of the whole file if row is negative.
+	// If it's nil, the source isn't linked to
+	Src func(fn string, row int) string
+}
+
+// pkgDocHTML renders pd as an html fragment in the style of godoc.
+// pkg is used to resolve doc links. Identifiers in declarations are linked to their documentation
+func pkgDocHTML(pkg *doc.Package, pd *PkgDoc, links pkgDocLinks) string {
+	pr := pkg.Printer()
+	pr.DocLinkURL = func(link *comment.DocLink) string {
+		frag := link.Name
+		if link.Recv != "" {
+			frag = link.Recv + "." + link.Name
+		}
+		u := ""
+		if link.ImportPath != "" && link.ImportPath != pd.ImportPath {
+			u = links.Pkg(link.ImportPath)
+		}
+		if frag != "" {
+			u += "#" + frag
+		}
+		return u
+	}
+	names := map[string]bool{}
+	for _, v := range append(append([]*PkgDocValue{}, pd.Consts...), pd.Vars...) {
+		for _, name := range v.Names {
+			names[name] = true
+		}
+	}
+	for _, f := range pd.Funcs {
+		names[f.Name] = true
+	}
+	for _, t := range pd.Types {
+		names[t.Name] = true
+		for _, v := range append(append([]*PkgDocValue{}, t.Consts...), t.Vars...) {
+			for _, name := range v.Names {
+				names[name] = true
+			}
+		}
+		for _, f := range t.Funcs {
+			names[f.Name] = true
+		}
+	}
+
+	docComment := func(buf *bytes.Buffer, text string) {
+		if text != "" {
+			buf.Write(pr.HTML(pkg.Parser().Parse(text)))
+		}
+	}
+	pre := func(buf *bytes.Buffer, src string) {
+		fmt.Fprintf(buf, "<pre>%s</pre>\n", html.EscapeString(strings.TrimRight(src, "\n")))
+	}
+	decl := func(buf *bytes.Buffer, src, fn string) {
+		fmt.Fprintf(buf, "<pre>%s</pre>\n", linkDecl(strings.TrimRight(src, "\n"), names, pd.imports[fn], links))
+	}
+	name := func(s, fn string, row int) string {
+		if links.Src == nil {
+			return html.EscapeString(s)
+		}
+		return fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(links.Src(fn, row)), html.EscapeString(s))
+	}
+	examples := func(buf *bytes.Buffer, l []*PkgDocExample) {
+		for _, ex := range l {
+			title := "Example"
+			if ex.Suffix != "" {
+				title += " (" + ex.Suffix + ")"
+			}
+			id := ex.Name
+			if id == "" {
+				id = "package"
+			}
+			fmt.Fprintf(buf, "<details id=\"example-%s\">\n<summary>%s</summary>\n", html.EscapeString(id), html.EscapeString(title))
+			docComment(buf, ex.Doc)
+			pre(buf, ex.Code)
+			if ex.Output != "" || ex.EmptyOutput {
+				buf.WriteString("<p>Output:</p>\n")
+				pre(buf, ex.Output)
+			}
+			buf.WriteString("</details>\n")
+		}
+	}
+	values := func(buf *bytes.Buffer, l []*PkgDocValue) {
+		for _, v := range l {
+			decl(buf, v.Decl, v.Fn)
+			docComment(buf, v.Doc)
+		}
+	}
+	funcs := func(buf *bytes.Buffer, l []*PkgDocFunc, tag string) {
+		for _, f := range l {
+			id := pkgDocFuncID(f)
+			if f.Recv != "" {
+				fmt.Fprintf(buf, "<%s id=\"%s\">func (%s) %s</%s>\n", tag, html.EscapeString(id), html.EscapeString(f.Recv), name(f.Name, f.Fn, f.Row), tag)
+			} else {
+				fmt.Fprintf(buf, "<%s id=\"%s\">func %s</%s>\n", tag, html.EscapeString(id), name(f.Name, f.Fn, f.Row), tag)
+			}
+			decl(buf, f.Decl, f.Fn)
+			docComment(buf, f.Doc)
+			examples(buf, f.Examples)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<h1>package %s</h1>\n", html.EscapeString(pd.Name))
+	fmt.Fprintf(buf, "<p><code>import %q</code></p>\n", html.EscapeString(pd.ImportPath))
+
+	buf.WriteString("<section id=\"pkg-overview\">\n<h2>Overview</h2>\n")
+	docComment(buf, pd.Doc)
+	examples(buf, pd.Examples)
+	buf.WriteString("</section>\n")
+
+	buf.WriteString("<section id=\"pkg-index\">\n<h2>Index</h2>\n<ul>\n")
+	if len(pd.Consts) != 0 {
+		buf.WriteString("<li><a href=\"#pkg-constants\">Constants</a></li>\n")
+	}
+	if len(pd.Vars) != 0 {
+		buf.WriteString("<li><a href=\"#pkg-variables\">Variables</a></li>\n")
+	}
+	index := func(f *PkgDocFunc) {
+		s := strings.TrimPrefix(strings.TrimSpace(f.Decl), "func ")
+		fmt.Fprintf(buf, "<li><a href=\"#%s\">func %s</a></li>\n", html.EscapeString(pkgDocFuncID(f)), html.EscapeString(s))
+	}
+	for _, f := range pd.Funcs {
+		index(f)
+	}
+	for _, t := range pd.Types {
+		fmt.Fprintf(buf, "<li><a href=\"#%s\">type %s</a>\n<ul>\n", html.EscapeString(t.Name), html.EscapeString(t.Name))
+		for _, f := range t.Funcs {
+			index(f)
+		}
+		for _, f := range t.Methods {
+			index(f)
+		}
+		buf.WriteString("</ul>\n</li>\n")
+	}
+	if len(pd.Bugs) != 0 {
+		buf.WriteString("<li><a href=\"#pkg-note-BUG\">Bugs</a></li>\n")
+	}
+	buf.WriteString("</ul>\n")
+	if links.Src != nil && len(pd.Filenames) != 0 {
+		buf.WriteString("<h3>Package files</h3>\n<p>\n")
+		for _, fn := range pd.Filenames {
+			fmt.Fprintf(buf, "<a href=\"%s\">%s</a>\n", html.EscapeString(links.Src(fn, -1)), html.EscapeString(filepath.Base(fn)))
+		}
+		buf.WriteString("</p>\n")
+	}
+	buf.WriteString("</section>\n")
+
+	if len(pd.Consts) != 0 {
+		buf.WriteString("<section id=\"pkg-constants\">\n<h2>Constants</h2>\n")
+		values(buf, pd.Consts)
+		buf.WriteString("</section>\n")
+	}
+	if len(pd.Vars) != 0 {
+		buf.WriteString("<section id=\"pkg-variables\">\n<h2>Variables</h2>\n")
+		values(buf, pd.Vars)
+		buf.WriteString("</section>\n")
+	}
+	if len(pd.Funcs) != 0 {
+		buf.WriteString("<section id=\"pkg-functions\">\n")
+		funcs(buf, pd.Funcs, "h2")
+		buf.WriteString("</section>\n")
+	}
+	if len(pd.Types) != 0 {
+		buf.WriteString("<section id=\"pkg-types\">\n")
+		for _, t := range pd.Types {
+			fmt.Fprintf(buf, "<h2 id=\"%s\">type %s</h2>\n", html.EscapeString(t.Name), name(t.Name, t.Fn, t.Row))
+			decl(buf, t.Decl, t.Fn)
+			docComment(buf, t.Doc)
+			values(buf, t.Consts)
+			values(buf, t.Vars)
+			examples(buf, t.Examples)
+			funcs(buf, t.Funcs, "h3")
+			funcs(buf, t.Methods, "h3")
+		}
+		buf.WriteString("</section>\n")
+	}
+	if len(pd.Bugs) != 0 {
+		buf.WriteString("<section id=\"pkg-note-BUG\">\n<h2>Bugs</h2>\n<ul>\n")
+		for _, s := range pd.Bugs {
+			buf.WriteString("<li>")
+			docComment(buf, s)
+			buf.WriteString("</li>\n")
+		}
+		buf.WriteString("</ul>\n</section>\n")
+	}
+	return buf.String()
+}
+
+// linkDecl returns the declaration src as html, with the identifiers it uses linked to their documentation.
+// names is the set of package-level names documented on the page
+// and imports maps the names of the imports of the file it's declared in, to their import paths
+func linkDecl(src string, names map[string]bool, imports map[string]string, links pkgDocLinks) string {
+	const hdr = "package p\n"
+	fset := token.NewFileSet()
+	af, err := parser.ParseFile(fset, "", hdr+src, parser.SkipObjectResolution)
+	if err != nil {
+		return html.EscapeString(src)
+	}
+
+	// names being declared, as opposed to used, aren't linked
+	defs := map[*ast.Ident]bool{}
+	fields := func(fl *ast.FieldList) {
+		if fl != nil {
+			for _, f := range fl.List {
+				for _, id := range f.Names {
+					defs[id] = true
+				}
+			}
+		}
+	}
+	ast.Inspect(af, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.FuncDecl:
+			defs[v.Name] = true
+			fields(v.Recv)
+			fields(v.Type.TypeParams)
+		case *ast.FuncType:
+			fields(v.Params)
+			fields(v.Results)
+		case *ast.TypeSpec:
+			defs[v.Name] = true
+			fields(v.TypeParams)
+		case *ast.ValueSpec:
+			for _, id := range v.Names {
+				defs[id] = true
+			}
+		case *ast.StructType:
+			fields(v.Fields)
+		case *ast.InterfaceType:
+			fields(v.Methods)
+		}
+		return true
+	})
+
+	type link struct {
+		pos, end int
+		url      string
+	}
+	ll := []link{}
+	add := func(n ast.Node, url string) {
+		ll = append(ll, link{
+			pos: fset.Position(n.Pos()).Offset - len(hdr),
+			end: fset.Position(n.End()).Offset - len(hdr),
+			url: url,
+		})
+	}
+	ast.Inspect(af, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.SelectorExpr:
+			if x, ok := v.X.(*ast.Ident); ok {
+				if p, ok := imports[x.Name]; ok {
+					add(x, links.Pkg(p))
+					add(v.Sel, links.Pkg(p)+"#"+v.Sel.Name)
+					return false
+				}
+			}
+		case *ast.Ident:
+			switch {
+			case defs[v] || v.Name == "_":
+			case names[v.Name]:
+				add(v, "#"+v.Name)
+			case types.Universe.Lookup(v.Name) != nil:
+				add(v, links.Pkg("builtin")+"#"+v.Name)
+			}
+		}
+		return true
+	})
+
+	buf := &bytes.Buffer{}
+	i := 0
+	for _, l := range ll {
+		if l.pos < i || l.end > len(src) {
+			continue
+		}
+		buf.WriteString(html.EscapeString(src[i:l.pos]))
+		fmt.Fprintf(buf, "<a href=\"%s\">%s</a>", html.EscapeString(l.url), html.EscapeString(src[l.pos:l.end]))
+		i = l.end
+	}
+	buf.WriteString(html.EscapeString(src[i:]))
+	return buf.String()
+}
+
+// pkgDocFuncID returns the html id of the func or method f i.e. Name or Type.Name
+func pkgDocFuncID(f *PkgDocFunc) string {
+	if f.Recv == "" {
+		return f.Name
+	}
+	recv := strings.TrimLeft(f.Recv, "*")
+	// generic receivers e.g. T[K] are identified by their type name
+	if i := strings.Index(recv, "["); i >= 0 {
+		recv = recv[:i]
+	}
+	return recv + "." + f.Name
+}
@@ -1,23 +1,57 @@
 package main
 
 import (
+	"go/ast"
+	"go/build/constraint"
 	"go/parser"
 	"go/token"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type PkgFilesArgs struct {
-	Path string `json:"path"`
+	Path    string            `json:"path"`
+	Details bool              `json:"details"`
+	Env     map[string]string `json:"env"`
+	Tags    []string          `json:"tags"`
+}
+
+// PkgFileInfo describes a file in a package dir.
+// Test is `internal` for a _test.go file in the package, `external` for one in the _test package and empty otherwise.
+// Included reports whether the file is compiled for the GOOS, GOARCH and build tags in effect.
+// Constraint is the file's //go:build (or // +build) expression and Tags the build tags it mentions,
+// including the GOOS and GOARCH implied by its name e.g. linux and amd64 for file_linux_amd64.go.
+type PkgFileInfo struct {
+	Fn         string   `json:"fn"`
+	Test       string   `json:"test"`
+	Included   bool     `json:"included"`
+	Constraint string   `json:"constraint"`
+	Tags       []string `json:"tags"`
+	Cgo        bool     `json:"cgo"`
+	Size       int64    `json:"size"`
+	ModTime    int64    `json:"mod_time"`
 }
 
 func init() {
 	act(Action{
 		Path: "/pkgfiles",
-		Doc:  ``,
+		Doc: `
+lists the files in the dir path, grouped by package name
+@data: {"path": "...", "details": false, "env": {}, "tags": []}
+@resp: {"pkgname": {"file.go": "/path/file.go"}}
+if details is true, each file is instead described by an object.
+included is evaluated for the GOOS, GOARCH and CGO_ENABLED in env (default: MarGo's own) and the build tags in tags.
+mod_time is in seconds since the unix epoch
+@resp: {"pkgname": {"file.go": {"fn": "/path/file.go", "test": "", "included": true, "constraint": "linux && !appengine", "tags": ["appengine", "linux"], "cgo": false, "size": 0, "mod_time": 0}}}
+`,
 		Func: func(r Request) (data, error) {
 			res := map[string]map[string]string{}
-			a := PkgFilesArgs{}
+			a := PkgFilesArgs{
+				Env:  map[string]string{},
+				Tags: []string{},
+			}
 			if err := r.Decode(&a); err != nil {
 				return res, err
 			}
@@ -27,33 +61,168 @@ func init() {
 				return res, err
 			}
 
+			mode := parser.PackageClauseOnly
+			if a.Details {
+				mode = parser.ImportsOnly | parser.ParseComments
+			}
 			fset := token.NewFileSet()
-			pkgs, _ := parser.ParseDir(fset, srcDir, isGoFile, parser.PackageClauseOnly)
+			pkgs, _ := parser.ParseDir(fset, srcDir, isGoFile, mode)
+			details := map[string]map[string]*PkgFileInfo{}
+			ctx := buildContext(a.Env, a.Tags)
 			if pkgs != nil {
 				for pkgName, pkg := range pkgs {
 					list := map[string]string{}
+					infos := map[string]*PkgFileInfo{}
 					for _, f := range pkg.Files {
 						tp := fset.Position(f.Pos())
 						if !tp.IsValid() {
 							continue
 						}
 
-						if _, err := os.Stat(tp.Filename); err != nil {
+						fi, err := os.Stat(tp.Filename)
+						if err != nil {
 							continue
 						}
 
 						fn, _ := filepath.Rel(srcDir, tp.Filename)
-						if fn != "" {
-							list[fn] = tp.Filename
+						if fn == "" {
+							continue
+						}
+						list[fn] = tp.Filename
+
+						if a.Details {
+							p := &PkgFileInfo{
+								Fn:      tp.Filename,
+								Size:    fi.Size(),
+								ModTime: fi.ModTime().Unix(),
+								Tags:    []string{},
+							}
+							if strings.HasSuffix(fn, "_test.go") {
+								if strings.HasSuffix(pkgName, "_test") {
+									p.Test = "external"
+								} else {
+									p.Test = "internal"
+								}
+							}
+							p.Included, _ = ctx.MatchFile(srcDir, fn)
+							tags := map[string]bool{}
+							if x := fileConstraint(f); x != nil {
+								p.Constraint = x.String()
+								for _, tag := range constraintTags(x) {
+									tags[tag] = true
+								}
+							}
+							for _, tag := range fileNameTags(fn) {
+								tags[tag] = true
+							}
+							for tag, _ := range tags {
+								p.Tags = append(p.Tags, tag)
+							}
+							sort.Strings(p.Tags)
+							for _, ispec := range f.Imports {
+								if unquote(ispec.Path.Value) == "C" {
+									p.Cgo = true
+								}
+							}
+							infos[fn] = p
 						}
 					}
 					if len(list) > 0 {
 						res[pkgName] = list
+						details[pkgName] = infos
 					}
 				}
 			}
 
+			if a.Details {
+				return details, nil
+			}
 			return res, nil
 		},
 	})
 }
+
+// fileConstraint returns the build constraint of af, preferring the //go:build line over // +build lines
+func fileConstraint(af *ast.File) constraint.Expr {
+	var plusBuild constraint.Expr
+	for _, cg := range af.Comments {
+		if cg.Pos() >= af.Package {
+			break
+		}
+		for _, c := range cg.List {
+			if constraint.IsGoBuild(c.Text) {
+				if x, err := constraint.Parse(c.Text); err == nil {
+					return x
+				}
+			} else if constraint.IsPlusBuild(c.Text) {
+				if x, err := constraint.Parse(c.Text); err == nil {
+					if plusBuild == nil {
+						plusBuild = x
+					} else {
+						plusBuild = &constraint.AndExpr{X: plusBuild, Y: x}
+					}
+				}
+			}
+		}
+	}
+	return plusBuild
+}
+
+var (
+	knownOS   = listSet("aix android darwin dragonfly freebsd hurd illumos ios js linux nacl netbsd openbsd plan9 solaris wasip1 windows zos")
+	knownArch = listSet("386 amd64 amd64p32 arm armbe arm64 arm64be loong64 mips mipsle mips64 mips64le mips64p32 mips64p32le ppc ppc64 ppc64le riscv riscv64 s390 s390x sparc sparc64 wasm")
+)
+
+func listSet(s string) map[string]bool {
+	m := map[string]bool{}
+	for _, k := range strings.Fields(s) {
+		m[k] = true
+	}
+	return m
+}
+
+// fileNameTags returns the GOOS and GOARCH tags implied by the name of the file fn,
+// following the same *_GOOS, *_GOARCH and *_GOOS_GOARCH rules as go/build
+func fileNameTags(fn string) []string {
+	name := strings.TrimSuffix(filepath.Base(fn), ".go")
+	if i := strings.Index(name, "_"); i >= 0 {
+		name = name[i:]
+	} else {
+		return nil
+	}
+	l := strings.Split(strings.TrimSuffix(name, "_test"), "_")
+	if n := len(l); n >= 2 && knownOS[l[n-2]] && knownArch[l[n-1]] {
+		return []string{l[n-2], l[n-1]}
+	} else if n >= 1 && (knownOS[l[n-1]] || knownArch[l[n-1]]) {
+		return []string{l[n-1]}
+	}
+	return nil
+}
+
+// constraintTags returns the sorted list of tags mentioned in x
+func constraintTags(x constraint.Expr) []string {
+	seen := map[string]bool{}
+	var walk func(x constraint.Expr)
+	walk = func(x constraint.Expr) {
+		switch x := x.(type) {
+		case *constraint.TagExpr:
+			seen[x.Tag] = true
+		case *constraint.NotExpr:
+			walk(x.X)
+		case *constraint.AndExpr:
+			walk(x.X)
+			walk(x.Y)
+		case *constraint.OrExpr:
+			walk(x.X)
+			walk(x.Y)
+		}
+	}
+	walk(x)
+
+	tags := []string{}
+	for tag, _ := range seen {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
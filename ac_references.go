@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type ReferencesArgs struct {
+	Fn     string            `json:"fn"`
+	Src    string            `json:"src"`
+	Offset int               `json:"offset"`
+	Env    map[string]string `json:"env"`
+	Scope  string            `json:"scope"`
+	Dirs   []string          `json:"dirs"`
+}
+
+type ReferencesResult struct {
+	Name  string          `json:"name"`
+	Kind  string          `json:"kind"`
+	Pkg   string          `json:"pkg"`
+	Files []*RefFile      `json:"files"`
+	Decl  *Ref            `json:"decl"`
+	refs  map[string]bool // the positions of the refs found so far
+}
+
+type RefFile struct {
+	Fn   string `json:"fn"`
+	Refs []*Ref `json:"refs"`
+}
+
+// Ref is a reference to an object. Line is the (whole) line of source it appears on.
+// Decl is true if the reference is the object's declaration
+type Ref struct {
+	Fn   string `json:"fn"`
+	Row  int    `json:"row"`
+	Col  int    `json:"col"`
+	Line string `json:"line"`
+	Decl bool   `json:"decl"`
+
+	offset int
+}
+
+func init() {
+	act(Action{
+		Path: "/references",
+		Doc: `
+finds the references to the identifier at offset in the file fn (whose content is src, if set)
+@data: {"fn": "...", "src": "...", "offset": 0, "env": {}, "scope": "package", "dirs": []}
+@resp: {"name": "", "kind": "", "pkg": "", "decl": {}, "files": [{"fn": "...", "refs": [{"fn": "...", "row": 0, "col": 0, "line": "...", "decl": false}]}]}
+scope is one of:
+	package: the package containing fn, including its tests (the default)
+	importers: the package, the package declaring the identifier and all the packages in GOROOT, GOPATH and the enclosing module that import it
+	dirs: the package, the package declaring the identifier and the packages in the list of dirs
+identifiers declared in a function, and unexported ones, are only searched for in the package
+`,
+		Func: func(r Request) (data, error) {
+			a := ReferencesArgs{
+				Env:   map[string]string{},
+				Scope: "package",
+			}
+			if err := r.Decode(&a); err != nil {
+				return newReferencesResult(), err
+			}
+
+			res, _, _, err := findReferences(a.Env, a.Fn, a.Src, a.Offset, a.Scope, a.Dirs, nil)
+			return res, err
+		},
+	})
+}
+
+func newReferencesResult() *ReferencesResult {
+	return &ReferencesResult{
+		Files: []*RefFile{},
+		refs:  map[string]bool{},
+	}
+}
+
+// findReferences finds the references to the identifier at offset in the file fn, whose content is src if set,
+// within scope (see /references). The content of other files may be overridden by overlay.
+// The object the identifier refers to and the packages that were searched, the first of which is the package
+// containing fn, are also returned
+func findReferences(env map[string]string, fn, src string, offset int, scope string, scopeDirs []string, overlay map[string]string) (*ReferencesResult, types.Object, []*typeCheckPkg, error) {
+	res := newReferencesResult()
+	if fn == "" {
+		return res, nil, nil, errors.New("fn must be set")
+	}
+	fn, _ = filepath.Abs(fn)
+
+	ov := map[string]string{}
+	for k, v := range overlay {
+		ov[k] = v
+	}
+	if src != "" {
+		ov[fn] = src
+	}
+
+	tc, err := typeCheck(env, fn, ov[fn], ov)
+	if err != nil {
+		return res, nil, nil, err
+	}
+	tobj := typeObjAt(tc, offset)
+	if tobj == nil {
+		return res, nil, nil, errors.New("no identifier at offset")
+	}
+
+	key := typeObjKey(tc.Fset, tobj)
+	res.Name = tobj.Name()
+	res.Kind = typeObjKind(tobj)
+	if tobj.Pkg() != nil {
+		res.Pkg = tobj.Pkg().Path()
+	}
+	if key == "" {
+		return res, tobj, nil, errors.New("cannot find the references of builtin " + tobj.Name())
+	}
+
+	dirs := []string{filepath.Dir(fn)}
+	declDir := filepath.Dir(tc.Fset.Position(tobj.Pos()).Filename)
+	if tobj.Exported() && (tobj.Pkg() == nil || tobj.Parent() == nil || tobj.Parent() == tobj.Pkg().Scope()) {
+		switch scope {
+		case "package", "":
+		case "importers":
+			dirs = append(dirs, declDir)
+			dirs = append(dirs, importerDirs(env, fn, res.Pkg)...)
+		case "dirs":
+			dirs = append(dirs, declDir)
+			for _, dir := range scopeDirs {
+				if dir, err := filepath.Abs(dir); err == nil {
+					dirs = append(dirs, dir)
+				}
+			}
+		default:
+			return res, tobj, nil, errors.New("unknown scope: " + scope)
+		}
+	}
+
+	// the package of fn is always searched, even if fn is excluded by build constraints,
+	// and the other packages in its dir are only checked if they're not the same package
+	pkgs := []*typeCheckPkg{tc}
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		var checked *typeCheckPkg
+		if dir == filepath.Dir(fn) {
+			checked = tc
+		}
+		pkgs = append(pkgs, typeCheckDir(env, dir, ov, checked)...)
+	}
+	for _, tc := range pkgs {
+		res.collect(tc, map[string]bool{key: true}, ov)
+	}
+	res.sort()
+	return res, tobj, pkgs, nil
+}
+
+func (res *ReferencesResult) sort() {
+	sort.Sort(refFiles(res.Files))
+	for _, rf := range res.Files {
+		sort.Sort(refList(rf.Refs))
+	}
+}
+
+// collect adds the references to the objects identified by keys in the package tc
+func (res *ReferencesResult) collect(tc *typeCheckPkg, keys map[string]bool, overlay map[string]string) {
+	lines := map[string][]string{}
+	add := func(id *ast.Ident, decl bool) {
+		tp := tc.Fset.Position(id.Pos())
+		k := typeObjKeyPos(tp.Filename, tp.Offset)
+		if res.refs[k] {
+			return
+		}
+		res.refs[k] = true
+
+		l, ok := lines[tp.Filename]
+		if !ok {
+			s, ok := overlay[tp.Filename]
+			if !ok {
+				b, _ := ioutil.ReadFile(tp.Filename)
+				s = string(b)
+			}
+			l = strings.Split(s, "\n")
+			lines[tp.Filename] = l
+		}
+
+		ref := &Ref{
+			Fn:   tp.Filename,
+			Row:  tp.Line - 1,
+			Col:  tp.Column - 1,
+			Decl: decl,
+
+			offset: tp.Offset,
+		}
+		if ref.Row < len(l) {
+			ref.Line = strings.TrimRight(l[ref.Row], "\r")
+		}
+		if decl {
+			res.Decl = ref
+		}
+
+		var rf *RefFile
+		for _, f := range res.Files {
+			if f.Fn == ref.Fn {
+				rf = f
+				break
+			}
+		}
+		if rf == nil {
+			rf = &RefFile{Fn: ref.Fn}
+			res.Files = append(res.Files, rf)
+		}
+		rf.Refs = append(rf.Refs, ref)
+	}
+
+	for id, obj := range tc.Info.Defs {
+		if obj != nil && keys[typeObjKey(tc.Fset, obj)] {
+			add(id, true)
+		}
+	}
+	for id, obj := range tc.Info.Uses {
+		if keys[typeObjKey(tc.Fset, obj)] {
+			add(id, false)
+		}
+	}
+}
+
+// importerDirs returns the package dirs in GOROOT, GOPATH and the module containing fn that import importPath
+func importerDirs(env map[string]string, fn, importPath string) []string {
+	dirs := []string{}
+	check := func(m map[string]string) {
+		for _, pkgFn := range m {
+			dir := filepath.Dir(pkgFn)
+			if _, ok := dirImportUsage(dir)[importPath]; ok {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	for _, m := range pkgDirs(env) {
+		check(m)
+	}
+	if modRoot, _ := findModule(filepath.Dir(fn)); modRoot != "" {
+		check(walkRootDir(modRoot, defaultWalkOptions()))
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// typeObjAt returns the object defined or used by the identifier at offset in the file tc.File
+func typeObjAt(tc *typeCheckPkg, offset int) types.Object {
+	_, id := identAt(tc.Fset, tc.File, offset)
+	if id == nil {
+		return nil
+	}
+	if obj := tc.Info.Defs[id]; obj != nil {
+		return obj
+	}
+	if obj := tc.Info.Uses[id]; obj != nil {
+		return obj
+	}
+	// the name in a type switch guard declares a separate object in each clause
+	for node, obj := range tc.Info.Implicits {
+		if _, ok := node.(*ast.CaseClause); ok && obj.Pos() == id.Pos() {
+			return obj
+		}
+	}
+	return nil
+}
+
+// typeObjKind returns the kind of obj. The names match ast.ObjKind's, with method, field and builtin added
+func typeObjKind(obj types.Object) string {
+	switch v := obj.(type) {
+	case *types.Func:
+		if sig, ok := v.Type().(*types.Signature); ok && sig.Recv() != nil {
+			return "method"
+		}
+		return "func"
+	case *types.Var:
+		if v.IsField() {
+			return "field"
+		}
+		return "var"
+	case *types.Const:
+		return "const"
+	case *types.TypeName:
+		return "type"
+	case *types.Label:
+		return "label"
+	case *types.PkgName:
+		return "package"
+	case *types.Builtin:
+		return "builtin"
+	}
+	return "bad"
+}
+
+type refFiles []*RefFile
+
+func (l refFiles) Len() int {
+	return len(l)
+}
+
+func (l refFiles) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l refFiles) Less(i, j int) bool {
+	return l[i].Fn < l[j].Fn
+}
+
+type refList []*Ref
+
+func (l refList) Len() int {
+	return len(l)
+}
+
+func (l refList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l refList) Less(i, j int) bool {
+	if l[i].Row != l[j].Row {
+		return l[i].Row < l[j].Row
+	}
+	return l[i].Col < l[j].Col
+}
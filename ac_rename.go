@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type RenameArgs struct {
+	Fn       string            `json:"fn"`
+	Src      string            `json:"src"`
+	Offset   int               `json:"offset"`
+	Name     string            `json:"name"`
+	Env      map[string]string `json:"env"`
+	Overlays map[string]string `json:"overlays"`
+}
+
+type RenameResult struct {
+	Files     []*RenameFile     `json:"files"`
+	Conflicts []*RenameConflict `json:"conflicts"`
+}
+
+// RenameFile is the list of edits to apply to the file Fn, see TextEdit
+type RenameFile struct {
+	Fn    string      `json:"fn"`
+	Edits []*TextEdit `json:"edits"`
+}
+
+// RenameConflict is a reason the rename was refused, at position Row/Col of the file Fn
+type RenameConflict struct {
+	Fn  string `json:"fn"`
+	Row int    `json:"row"`
+	Col int    `json:"col"`
+	Msg string `json:"msg"`
+}
+
+// renameSite is a reference to the renamed object in a type-checked package
+type renameSite struct {
+	tc  *typeCheckPkg
+	id  *ast.Ident
+	obj types.Object
+}
+
+func init() {
+	act(Action{
+		Path: "/rename",
+		Doc: `
+renames the identifier at offset in the file fn (whose content is src, if set) to name
+@data: {"fn": "...", "src": "...", "offset": 0, "name": "", "env": {}, "overlays": {"/path/file.go": "unsaved src"}}
+@resp: {"files": [{"fn": "...", "edits": [{"start": 0, "end": 0, "row": 0, "col": 0, "end_row": 0, "end_col": 0, "text": ""}]}], "conflicts": []}
+the package is type-checked, along with its importers in GOROOT, GOPATH and the enclosing module if the identifier is exported.
+overlays maps filenames to their unsaved content which is used instead of the content on disk, and edits are relative to it.
+if the rename would change the meaning of the program e.g. because the name is already declared, the new name would be shadowed
+or a type would no longer implement an interface, no edits are returned. instead the conflicts are listed and an error is returned
+`,
+		Func: func(r Request) (data, error) {
+			res := RenameResult{
+				Files:     []*RenameFile{},
+				Conflicts: []*RenameConflict{},
+			}
+			a := RenameArgs{
+				Env:      map[string]string{},
+				Overlays: map[string]string{},
+			}
+			if err := r.Decode(&a); err != nil {
+				return res, err
+			}
+			if !token.IsIdentifier(a.Name) || a.Name == "_" {
+				return res, fmt.Errorf("%q is not a valid identifier", a.Name)
+			}
+
+			overlay := map[string]string{}
+			for fn, s := range a.Overlays {
+				if fn, err := filepath.Abs(fn); err == nil {
+					overlay[fn] = s
+				}
+			}
+			if a.Src != "" {
+				if fn, err := filepath.Abs(a.Fn); err == nil {
+					overlay[fn] = a.Src
+				}
+			}
+
+			refs, tobj, pkgs, err := findReferences(a.Env, a.Fn, a.Src, a.Offset, "importers", nil, overlay)
+			if err != nil {
+				return res, err
+			}
+			if tobj.Name() == a.Name {
+				return res, nil
+			}
+			switch tobj.(type) {
+			case *types.PkgName:
+				return res, errors.New("renaming imports is not supported")
+			case *types.Label:
+			default:
+				if tobj.Pkg() == nil {
+					return res, errors.New("cannot rename builtin " + tobj.Name())
+				}
+			}
+			if refs.Decl == nil {
+				return res, errors.New("cannot find the declaration of " + tobj.Name())
+			}
+			goroot := gorootSrc(envGoroot(a.Env))
+			if strings.HasPrefix(refs.Decl.Fn, goroot+string(filepath.Separator)) {
+				return res, errors.New("cannot rename " + tobj.Name() + ", it's declared in GOROOT")
+			}
+
+			// tobj comes from the check of the package containing fn, which is the first one searched
+			if len(pkgs) == 0 {
+				return res, errors.New("cannot find the package of " + a.Fn)
+			}
+
+			// renaming a type also renames the fields it's embedded as
+			keys := map[string]bool{
+				typeObjKey(pkgs[0].Fset, tobj): true,
+			}
+			n := len(keys)
+			for _, tc := range pkgs {
+				for id, obj := range tc.Info.Defs {
+					if v, ok := obj.(*types.Var); ok && v.Embedded() {
+						if u := tc.Info.Uses[id]; u != nil && keys[typeObjKey(tc.Fset, u)] {
+							keys[typeObjKey(tc.Fset, v)] = true
+						}
+					}
+				}
+			}
+			if len(keys) != n {
+				refs = newReferencesResult()
+				for _, tc := range pkgs {
+					refs.collect(tc, keys, overlay)
+				}
+				refs.sort()
+			}
+
+			sites := []renameSite{}
+			for _, tc := range pkgs {
+				for id, obj := range tc.Info.Defs {
+					if obj != nil && keys[typeObjKey(tc.Fset, obj)] {
+						sites = append(sites, renameSite{tc, id, obj})
+					}
+				}
+				for id, obj := range tc.Info.Uses {
+					if keys[typeObjKey(tc.Fset, obj)] {
+						sites = append(sites, renameSite{tc, id, obj})
+					}
+				}
+			}
+
+			res.Conflicts = renameConflicts(pkgs, sites, keys, tobj, a.Name)
+			if len(res.Conflicts) != 0 {
+				sort.Sort(renameConflictList(res.Conflicts))
+				return res, fmt.Errorf("cannot rename %s to %s: %s", tobj.Name(), a.Name, res.Conflicts[0].Msg)
+			}
+
+			for _, rf := range refs.Files {
+				s, ok := overlay[rf.Fn]
+				if !ok {
+					b, err := ioutil.ReadFile(rf.Fn)
+					if err != nil {
+						return RenameResult{Files: []*RenameFile{}, Conflicts: res.Conflicts}, err
+					}
+					s = string(b)
+				}
+
+				f := &RenameFile{
+					Fn:    rf.Fn,
+					Edits: []*TextEdit{},
+				}
+				for _, ref := range rf.Refs {
+					start, end := ref.offset, ref.offset+len(tobj.Name())
+					if end > len(s) || s[start:end] != tobj.Name() {
+						return RenameResult{Files: []*RenameFile{}, Conflicts: res.Conflicts},
+							fmt.Errorf("%s has changed since it was type-checked", rf.Fn)
+					}
+					f.Edits = appendTextEdit(f.Edits, s, start, end, a.Name)
+				}
+				res.Files = append(res.Files, f)
+			}
+			return res, nil
+		},
+	})
+}
+
+// renameConflicts returns the reasons why renaming the object tobj, identified by keys, to name would break the program
+func renameConflicts(pkgs []*typeCheckPkg, sites []renameSite, keys map[string]bool, tobj types.Object, name string) []*RenameConflict {
+	conflicts := []*RenameConflict{}
+	seen := map[string]bool{}
+	conflict := func(tc *typeCheckPkg, pos token.Pos, format string, a ...interface{}) {
+		tp := tc.Fset.Position(pos)
+		c := &RenameConflict{
+			Fn:  tp.Filename,
+			Row: tp.Line - 1,
+			Col: tp.Column - 1,
+			Msg: fmt.Sprintf(format, a...),
+		}
+		k := fmt.Sprintf("%s:%d:%s", c.Fn, tp.Offset, c.Msg)
+		if !seen[k] {
+			seen[k] = true
+			conflicts = append(conflicts, c)
+		}
+	}
+
+	declPkg := tobj.Pkg().Path()
+	for _, s := range sites {
+		tc, id, obj := s.tc, s.id, s.obj
+
+		if tobj.Exported() && !ast.IsExported(name) && tc.Pkg.Path() != declPkg {
+			conflict(tc, id.Pos(), "%s is used in package %s so it must remain exported", tobj.Name(), tc.Pkg.Path())
+		}
+
+		// fields and methods are only ever referenced through selectors, and
+		// references from other packages are qualified, so neither can be shadowed
+		if obj.Parent() == nil || tc.Pkg.Path() != declPkg {
+			continue
+		}
+
+		scope := tc.Pkg.Scope().Innermost(id.Pos())
+		if scope == nil {
+			continue
+		}
+		_, o := scope.LookupParent(name, id.Pos())
+		switch {
+		case o == nil || keys[typeObjKey(tc.Fset, o)]:
+		case o.Parent() == obj.Parent():
+			conflict(tc, id.Pos(), "%s is already declared in this scope at %s", name, tc.Fset.Position(o.Pos()))
+		case scopeEncloses(obj.Parent(), o.Parent()):
+			conflict(tc, id.Pos(), "this reference to %s would be shadowed by the declaration of %s at %s",
+				tobj.Name(), name, tc.Fset.Position(o.Pos()))
+		}
+	}
+
+	for _, s := range sites {
+		tc, decl := s.tc, s.obj
+		if tc.Info.Defs[s.id] != decl {
+			continue
+		}
+
+		if scope := decl.Parent(); scope != nil {
+			if o := scope.Lookup(name); o != nil && !keys[typeObjKey(tc.Fset, o)] {
+				conflict(tc, s.id.Pos(), "%s is already declared in this scope at %s", name, tc.Fset.Position(o.Pos()))
+			}
+
+			// the new name must not capture references to other objects of the same name
+			for id, o := range tc.Info.Uses {
+				if id.Name != name || o.Parent() == nil || o.Parent() == scope || !scopeEncloses(o.Parent(), scope) {
+					continue
+				}
+				if scope != tc.Pkg.Scope() && (!scope.Contains(id.Pos()) || id.Pos() < decl.Pos()) {
+					continue
+				}
+				conflict(tc, id.Pos(), "this reference to %s would refer to the renamed %s", name, tobj.Name())
+			}
+
+			// package-level names must not conflict with the imports of any file
+			if scope == tc.Pkg.Scope() {
+				for _, af := range tc.Files {
+					if fs := tc.Info.Scopes[af]; fs != nil {
+						if o := fs.Lookup(name); o != nil {
+							conflict(tc, o.Pos(), "%s conflicts with the import %s", name, o.Name())
+						}
+					}
+				}
+			}
+			continue
+		}
+
+		renameMemberConflicts(tc, decl, name, conflict)
+	}
+	return conflicts
+}
+
+// renameMemberConflicts checks renaming the field or method decl to name
+func renameMemberConflicts(tc *typeCheckPkg, decl types.Object, name string, conflict func(*typeCheckPkg, token.Pos, string, ...interface{})) {
+	if fn, ok := decl.(*types.Func); ok {
+		sig, _ := fn.Type().(*types.Signature)
+		if sig == nil || sig.Recv() == nil {
+			return
+		}
+		recv := sig.Recv().Type()
+		if p, ok := recv.(*types.Pointer); ok {
+			recv = p.Elem()
+		}
+
+		if o, _, _ := types.LookupFieldOrMethod(recv, true, tc.Pkg, name); o != nil {
+			conflict(tc, decl.Pos(), "%s already has a field or method named %s", recv, name)
+		}
+
+		if iface, ok := recv.Underlying().(*types.Interface); ok {
+			// the types implementing the interface would no longer do so
+			for _, t := range typeCheckNamedTypes(tc) {
+				if types.IsInterface(t) {
+					continue
+				}
+				if types.Implements(t, iface) || types.Implements(types.NewPointer(t), iface) {
+					conflict(tc, decl.Pos(), "%s would no longer implement %s", t, recv)
+				}
+			}
+			return
+		}
+
+		// the type would no longer implement the interfaces that require the method
+		for _, t := range typeCheckNamedTypes(tc) {
+			iface, ok := t.Underlying().(*types.Interface)
+			if !ok || iface.NumMethods() == 0 {
+				continue
+			}
+			hasMethod := false
+			for i := 0; i < iface.NumMethods(); i++ {
+				if iface.Method(i).Name() == decl.Name() {
+					hasMethod = true
+				}
+			}
+			if hasMethod && (types.Implements(recv, iface) || types.Implements(types.NewPointer(recv), iface)) {
+				conflict(tc, decl.Pos(), "%s would no longer implement %s", recv, t)
+			}
+		}
+		return
+	}
+
+	if v, ok := decl.(*types.Var); ok && v.IsField() {
+		for _, t := range typeCheckNamedTypes(tc) {
+			st, ok := t.Underlying().(*types.Struct)
+			if !ok {
+				continue
+			}
+			for i := 0; i < st.NumFields(); i++ {
+				if st.Field(i) != v {
+					continue
+				}
+				if o, _, _ := types.LookupFieldOrMethod(t, true, tc.Pkg, name); o != nil {
+					conflict(tc, decl.Pos(), "%s already has a field or method named %s", t, name)
+				}
+			}
+		}
+	}
+}
+
+// typeCheckNamedTypes returns the named, non-generic types declared at the package level of tc and the packages it imports
+func typeCheckNamedTypes(tc *typeCheckPkg) []types.Type {
+	l := []types.Type{}
+	for _, pkg := range append([]*types.Package{tc.Pkg}, tc.Pkg.Imports()...) {
+		scope := pkg.Scope()
+		for _, name := range scope.Names() {
+			if tn, ok := scope.Lookup(name).(*types.TypeName); ok && !tn.IsAlias() {
+				// the behaviour of types.Implements is unspecified for uninstantiated generic types
+				if t, ok := tn.Type().(*types.Named); ok && t.TypeParams().Len() == 0 {
+					l = append(l, tn.Type())
+				}
+			}
+		}
+	}
+	return l
+}
+
+// scopeEncloses reports whether the scope outer encloses, or is the same as, the scope inner
+func scopeEncloses(outer, inner *types.Scope) bool {
+	for s := inner; s != nil; s = s.Parent() {
+		if s == outer {
+			return true
+		}
+	}
+	return false
+}
+
+type renameConflictList []*RenameConflict
+
+func (l renameConflictList) Len() int {
+	return len(l)
+}
+
+func (l renameConflictList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l renameConflictList) Less(i, j int) bool {
+	if l[i].Fn != l[j].Fn {
+		return l[i].Fn < l[j].Fn
+	}
+	if l[i].Row != l[j].Row {
+		return l[i].Row < l[j].Row
+	}
+	return l[i].Col < l[j].Col
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"go/ast"
+	"sort"
+)
+
+type SuggestImportsArgs struct {
+	Fn     string            `json:"fn"`
+	Src    string            `json:"src"`
+	Offset int               `json:"offset"`
+	Env    map[string]string `json:"env"`
+}
+
+func init() {
+	act(Action{
+		Path: "/suggest_imports",
+		Doc: `
+suggests imports for the unresolved package name at offset e.g. json in json.Marshal
+@data: {"fn": "...", "src": "...", "offset": 0, "env": {}}
+@resp: [{"name": "", "path": "encoding/json", "add": true}]
+the candidates are ranked, best first, and each of them may be passed as-is in the /imports toggle list
+`,
+		Func: func(r Request) (data, error) {
+			res := []ImportDeclArg{}
+			a := SuggestImportsArgs{
+				Env: map[string]string{},
+			}
+			if err := r.Decode(&a); err != nil {
+				return res, err
+			}
+
+			// the source is likely incomplete so we make do with whatever we can parse
+			fset, af, err := parseAstFile(a.Fn, a.Src, 0)
+			if af == nil || af.Name == nil {
+				return res, err
+			}
+
+			sel, id := identAt(fset, af, a.Offset)
+			var x *ast.Ident
+			member := ""
+			if sel != nil {
+				if v, ok := sel.X.(*ast.Ident); ok {
+					x = v
+					member = sel.Sel.Name
+				}
+			} else if id != nil {
+				x = id
+			}
+			if x == nil || x.Obj != nil {
+				return res, nil
+			}
+
+			pkgScope, pkgImports := pkgContext(a.Fn, af)
+			if pkgScope[x.Name] {
+				return res, nil
+			}
+			srcRootDirs := rootDirs(a.Env)
+			for _, ispec := range af.Imports {
+				if resolvedSpecName(ispec, srcRootDirs) == x.Name {
+					return res, nil
+				}
+			}
+
+			sels := map[string]bool{}
+			if member != "" {
+				sels[member] = true
+			}
+			l := []string{}
+			for importPath, p := range knownImportPaths(a.Env, a.Fn) {
+				if p.Name == x.Name && (len(sels) == 0 || pkgExports(p.Dir, p.Name, sels)) {
+					l = append(l, importPath)
+				}
+			}
+
+			sort.Sort(importCandidates{l, pkgImports, importUsageCounts(a.Env)})
+			for _, importPath := range l {
+				res = append(res, ImportDeclArg{
+					Path: importPath,
+					Add:  true,
+				})
+			}
+			return res, nil
+		},
+	})
+}
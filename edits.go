@@ -0,0 +1,193 @@
+package main
+
+import (
+	"strings"
+)
+
+// TextEdit describes the replacement of the range [Start, End) of the original source with Text.
+// Offsets are byte offsets into the original source and Row/Col are zero-based.
+// A list of edits is sorted and non-overlapping so clients should apply them in reverse order.
+type TextEdit struct {
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Row    int    `json:"row"`
+	Col    int    `json:"col"`
+	EndRow int    `json:"end_row"`
+	EndCol int    `json:"end_col"`
+	Text   string `json:"text"`
+}
+
+// diffSeq returns the index pairs of the longest common subsequence of two sequences of length n and m
+// where eq reports whether a[i] equals b[j]. It's an implementation of Myers' O(ND) algorithm.
+func diffSeq(n, m int, eq func(i, j int) bool) [][2]int {
+	matches := [][2]int{}
+
+	// the common prefix and suffix are usually the bulk of the input so we skip over them
+	pfx := 0
+	for pfx < n && pfx < m && eq(pfx, pfx) {
+		matches = append(matches, [2]int{pfx, pfx})
+		pfx += 1
+	}
+	sfx := 0
+	for sfx < n-pfx && sfx < m-pfx && eq(n-sfx-1, m-sfx-1) {
+		sfx += 1
+	}
+
+	a0, a1 := pfx, n-sfx
+	b0, b1 := pfx, m-sfx
+	an, bn := a1-a0, b1-b0
+	if an > 0 && bn > 0 {
+		max := an + bn
+		off := max + 1
+		v := make([]int, 2*max+3)
+		trace := [][]int{}
+	search:
+		for d := 0; d <= max; d++ {
+			// step d only reads the paths in diagonals -d..d so that's all that's kept
+			trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+			for k := -d; k <= d; k += 2 {
+				x := 0
+				if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+					x = v[off+k+1]
+				} else {
+					x = v[off+k-1] + 1
+				}
+				y := x - k
+				for x < an && y < bn && eq(a0+x, b0+y) {
+					x += 1
+					y += 1
+				}
+				v[off+k] = x
+				if x >= an && y >= bn {
+					break search
+				}
+			}
+		}
+
+		// walk the trace backwards to recover the snakes.
+		// trace[d] holds the furthest reaching paths in diagonals -d..d before step d was taken
+		mid := [][2]int{}
+		x, y := an, bn
+		for d := len(trace) - 1; d > 0; d-- {
+			pv := trace[d]
+			k := x - y
+			pk := 0
+			if k == -d || (k != d && pv[d+k-1] < pv[d+k+1]) {
+				pk = k + 1
+			} else {
+				pk = k - 1
+			}
+			px := pv[d+pk]
+			py := px - pk
+			for x > px && y > py {
+				x -= 1
+				y -= 1
+				mid = append(mid, [2]int{a0 + x, b0 + y})
+			}
+			x, y = px, py
+		}
+		for x > 0 && y > 0 {
+			x -= 1
+			y -= 1
+			mid = append(mid, [2]int{a0 + x, b0 + y})
+		}
+		for i := len(mid) - 1; i >= 0; i-- {
+			matches = append(matches, mid[i])
+		}
+	}
+
+	for i := 0; i < sfx; i++ {
+		matches = append(matches, [2]int{a1 + i, b1 + i})
+	}
+	return matches
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if n := len(lines); n > 0 && lines[n-1] == "" {
+		lines = lines[:n-1]
+	}
+	return lines
+}
+
+// textEdits computes a minimal list of edits that transform src into dst.
+// The sources are first diffed by line, then each changed region is trimmed to the bytes that actually differ.
+func textEdits(src, dst string) []*TextEdit {
+	edits := []*TextEdit{}
+	if src == dst {
+		return edits
+	}
+
+	a := splitLines(src)
+	b := splitLines(dst)
+	aOffs := make([]int, len(a)+1)
+	for i, s := range a {
+		aOffs[i+1] = aOffs[i] + len(s)
+	}
+	bOffs := make([]int, len(b)+1)
+	for i, s := range b {
+		bOffs[i+1] = bOffs[i] + len(s)
+	}
+
+	matches := diffSeq(len(a), len(b), func(i, j int) bool {
+		return a[i] == b[j]
+	})
+	matches = append(matches, [2]int{len(a), len(b)})
+
+	ai, bi := 0, 0
+	for _, mt := range matches {
+		if mt[0] > ai || mt[1] > bi {
+			start, end := aOffs[ai], aOffs[mt[0]]
+			old := src[start:end]
+			text := dst[bOffs[bi]:bOffs[mt[1]]]
+			if len(old)+len(text) > maxByteDiff {
+				edits = appendTextEdit(edits, src, start, end, text)
+			} else {
+				edits = appendByteEdits(edits, src, start, old, text)
+			}
+		}
+		ai, bi = mt[0]+1, mt[1]+1
+	}
+	return edits
+}
+
+// changed regions larger than this are replaced wholesale instead of being diffed byte-by-byte
+const maxByteDiff = 4096
+
+// appendByteEdits diffs the region old (at offset base in src) against text byte-by-byte
+func appendByteEdits(edits []*TextEdit, src string, base int, old, text string) []*TextEdit {
+	matches := diffSeq(len(old), len(text), func(i, j int) bool {
+		return old[i] == text[j]
+	})
+	matches = append(matches, [2]int{len(old), len(text)})
+
+	ai, bi := 0, 0
+	for _, mt := range matches {
+		if mt[0] > ai || mt[1] > bi {
+			edits = appendTextEdit(edits, src, base+ai, base+mt[0], text[bi:mt[1]])
+		}
+		ai, bi = mt[0]+1, mt[1]+1
+	}
+	return edits
+}
+
+func appendTextEdit(edits []*TextEdit, src string, start, end int, text string) []*TextEdit {
+	e := &TextEdit{
+		Start: start,
+		End:   end,
+		Text:  text,
+	}
+	e.Row, e.Col = offsetRowCol(src, start)
+	e.EndRow, e.EndCol = offsetRowCol(src, end)
+	return append(edits, e)
+}
+
+// offsetRowCol converts the byte offset in s into a zero-based row and column
+func offsetRowCol(s string, offset int) (row, col int) {
+	if offset > len(s) {
+		offset = len(s)
+	}
+	row = strings.Count(s[:offset], "\n")
+	col = offset - (strings.LastIndex(s[:offset], "\n") + 1)
+	return
+}
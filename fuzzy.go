@@ -0,0 +1,115 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	fuzzyCharScore        = 1
+	fuzzySegmentBonus     = 8
+	fuzzyConsecutiveBonus = 5
+)
+
+func isSegmentStart(s string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	switch s[i-1] {
+	case '/', '.', '-', '_':
+		return true
+	}
+	return false
+}
+
+// fuzzyMatch reports whether the characters of query appear, in order, in s (ignoring case).
+// The best alignment is chosen, favouring matches at the start of path segments and runs of consecutive characters.
+// The matched byte ranges [start, end) of s are returned for highlighting.
+func fuzzyMatch(query, s string) (score int, ranges [][2]int, ok bool) {
+	q := []rune{}
+	for _, r := range query {
+		if !unicode.IsSpace(r) {
+			q = append(q, unicode.ToLower(r))
+		}
+	}
+	if len(q) == 0 {
+		return 0, [][2]int{}, true
+	}
+
+	// the byte offset of each rune in s
+	offs := []int{}
+	rs := []rune{}
+	for i, r := range s {
+		offs = append(offs, i)
+		rs = append(rs, unicode.ToLower(r))
+	}
+	n, m := len(q), len(rs)
+	if n > m {
+		return 0, nil, false
+	}
+
+	// best[i][j] is the best score for matching q[:i+1] with q[i] matched at rs[j], or -1
+	// prev[i][j] is the position of q[i-1] in that alignment
+	best := make([][]int, n)
+	prev := make([][]int, n)
+	for i := 0; i < n; i++ {
+		best[i] = make([]int, m)
+		prev[i] = make([]int, m)
+		for j := 0; j < m; j++ {
+			best[i][j] = -1
+			if rs[j] != q[i] {
+				continue
+			}
+
+			bonus := fuzzyCharScore
+			if isSegmentStart(s, offs[j]) {
+				bonus += fuzzySegmentBonus
+			}
+			if i == 0 {
+				best[i][j] = bonus
+				continue
+			}
+			for k := i - 1; k < j; k++ {
+				if best[i-1][k] < 0 {
+					continue
+				}
+				sc := best[i-1][k] + bonus
+				if k == j-1 {
+					sc += fuzzyConsecutiveBonus
+				}
+				if sc > best[i][j] {
+					best[i][j] = sc
+					prev[i][j] = k
+				}
+			}
+		}
+	}
+
+	end := -1
+	for j := 0; j < m; j++ {
+		if best[n-1][j] > score || (end < 0 && best[n-1][j] >= 0) {
+			score = best[n-1][j]
+			end = j
+		}
+	}
+	if end < 0 {
+		return 0, nil, false
+	}
+
+	pos := make([]int, n)
+	for i, j := n-1, end; i >= 0; i-- {
+		pos[i] = j
+		j = prev[i][j]
+	}
+	ranges = [][2]int{}
+	for _, j := range pos {
+		start := offs[j]
+		_, size := utf8.DecodeRuneInString(s[start:])
+		if l := len(ranges); l > 0 && ranges[l-1][1] == start {
+			ranges[l-1][1] = start + size
+		} else {
+			ranges = append(ranges, [2]int{start, start + size})
+		}
+	}
+	return score, ranges, true
+}
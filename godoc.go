@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// godocHandler serves package documentation, in the style of godoc, for the packages in GOROOT, GOPATH and modules.
+//
+//	PREFIX                 lists the packages
+//	PREFIX{import path}    shows the documentation of a package
+//	PREFIX-/src?fn={file}  shows the source of a file
+//
+// The query parameter `in` is the dir import paths are resolved relative to, so that module packages are found.
+// It's carried over to the links on each page. If `all` is set, unexported declarations are shown as well.
+// env configures GOROOT, GOPATH, etc. like the env passed to actions
+type godocHandler struct {
+	prefix string
+	env    map[string]string
+}
+
+// godocEnv returns the env the documentation is served with, taken from the environment margo is started in
+func godocEnv() map[string]string {
+	env := map[string]string{}
+	for _, k := range []string{"GOROOT", "GOPATH", "GOOS", "GOARCH", "CGO_ENABLED"} {
+		if v := os.Getenv(k); v != "" {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+func (h *godocHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	in := req.FormValue("in")
+	if in != "" {
+		in, _ = filepath.Abs(in)
+	}
+	all := req.FormValue("all") != ""
+
+	title := ""
+	body := ""
+	var err error
+	switch p := strings.Trim(strings.TrimPrefix(req.URL.Path, h.prefix), "/"); p {
+	case "":
+		title, body = "Packages", h.index(in)
+	case "-/src":
+		title, body, err = h.src(req.FormValue("fn"), in)
+	default:
+		title, body, err = h.pkg(p, in, all)
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(rw, godocPage, html.EscapeString(title), html.EscapeString(h.pkgURL("", in)), body)
+}
+
+// query returns the query string that carries in over to another page
+func (h *godocHandler) query(in string) string {
+	if in == "" {
+		return ""
+	}
+	return "?in=" + url.QueryEscape(in)
+}
+
+func (h *godocHandler) pkgURL(importPath, in string) string {
+	return h.prefix + importPath + h.query(in)
+}
+
+func (h *godocHandler) srcURL(fn, in string, row int) string {
+	s := h.prefix + "-/src?fn=" + url.QueryEscape(fn)
+	if in != "" {
+		s += "&in=" + url.QueryEscape(in)
+	}
+	if row >= 0 {
+		s += fmt.Sprintf("#L%d", row+1)
+	}
+	return s
+}
+
+// index lists the packages in the module containing in, if set, and in GOPATH and GOROOT
+func (h *godocHandler) index(in string) string {
+	buf := &bytes.Buffer{}
+	section := func(title string, m map[string]string) {
+		if len(m) == 0 {
+			return
+		}
+		l := []string{}
+		for p, _ := range m {
+			l = append(l, p)
+		}
+		sort.Strings(l)
+
+		fmt.Fprintf(buf, "<h2>%s</h2>\n<table>\n", html.EscapeString(title))
+		for _, p := range l {
+			fmt.Fprintf(buf, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td></tr>\n",
+				html.EscapeString(h.pkgURL(p, in)),
+				html.EscapeString(p),
+				html.EscapeString(pkgDirSynopsis(filepath.Dir(m[p]))),
+			)
+		}
+		buf.WriteString("</table>\n")
+	}
+
+	if in != "" {
+		if modRoot, modPath := findModule(in); modRoot != "" {
+			m := map[string]string{}
+			for p, fn := range walkRootDir(modRoot, defaultWalkOptions()) {
+				m[path.Join(modPath, p)] = fn
+			}
+			section(modPath+" ("+modRoot+")", m)
+		}
+	}
+
+	dirs := pkgDirs(h.env)
+	roots := []string{}
+	for root, _ := range dirs {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	for _, root := range roots {
+		section(root, dirs[root])
+	}
+	return buf.String()
+}
+
+// pkg renders the documentation of the package with import path p
+func (h *godocHandler) pkg(p, in string, all bool) (title, body string, err error) {
+	if filepath.IsAbs(p) {
+		return "", "", errors.New("invalid import path: " + p)
+	}
+	pkg, pd, err := pkgDoc(h.env, p, in, all, true, 4)
+	if err != nil {
+		return "", "", err
+	}
+	s := pkgDocHTML(pkg, pd, pkgDocLinks{
+		Pkg: func(p string) string {
+			return h.pkgURL(p, in)
+		},
+		Src: func(fn string, row int) string {
+			return h.srcURL(fn, in, row)
+		},
+	})
+	return p, s, nil
+}
+
+// src renders the source of the file fn with each line numbered and linked to by its anchor e.g. #L1.
+// Only .go files in GOROOT, GOPATH and the module containing in are shown
+func (h *godocHandler) src(fn, in string) (title, body string, err error) {
+	if !filepath.IsAbs(fn) || !strings.HasSuffix(fn, ".go") {
+		return "", "", errors.New("invalid filename: " + fn)
+	}
+	fn = filepath.Clean(fn)
+	dir := filepath.Dir(fn)
+	if !h.srcAllowed(fn, in) {
+		return "", "", errors.New("file is not in GOROOT, GOPATH or the module: " + fn)
+	}
+
+	s, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return "", "", err
+	}
+
+	buf := &bytes.Buffer{}
+	if p := dirImportPath(buildContext(h.env, nil), dir); p != "" {
+		fmt.Fprintf(buf, "<p>package <a href=\"%s\">%s</a></p>\n", html.EscapeString(h.pkgURL(p, in)), html.EscapeString(p))
+	}
+	buf.WriteString("<pre class=\"src\">")
+	for i, ln := range strings.Split(strings.TrimRight(string(s), "\n"), "\n") {
+		fmt.Fprintf(buf, "<span id=\"L%d\"><a class=\"ln\" href=\"#L%d\">%5d</a>  %s</span>\n", i+1, i+1, i+1, html.EscapeString(ln))
+	}
+	buf.WriteString("</pre>\n")
+	return fn, buf.String(), nil
+}
+
+// srcAllowed reports whether the file fn is in GOROOT, GOPATH or the module containing in.
+// Symlinks are resolved so they can't be used to reach files outside of them
+func (h *godocHandler) srcAllowed(fn, in string) bool {
+	ctx := buildContext(h.env, nil)
+	roots := append([]string{ctx.GOROOT}, filepath.SplitList(ctx.GOPATH)...)
+	if in != "" {
+		if modRoot, _ := findModule(in); modRoot != "" {
+			roots = append(roots, modRoot)
+		}
+	}
+
+	fn, err := filepath.EvalSymlinks(fn)
+	if err != nil {
+		return false
+	}
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		if s, err := filepath.EvalSymlinks(root); err == nil {
+			root = s
+		}
+		if strings.HasPrefix(fn, filepath.Clean(root)+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+const godocPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: sans-serif; max-width: 960px; margin: 0 auto; padding: 1em; line-height: 1.4; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; tab-size: 4; }
+pre.src { background: none; padding: 0; }
+pre.src span:target { background: #ffd; }
+a { color: #375eab; text-decoration: none; }
+a:hover { text-decoration: underline; }
+a.ln { color: #999; }
+td { padding: 0.1em 1em 0.1em 0; vertical-align: top; }
+details { margin: 0.5em 0; }
+summary { cursor: pointer; color: #375eab; }
+</style>
+</head>
+<body>
+<nav><a href="%s">Packages</a></nav>
+%s
+</body>
+</html>
+`
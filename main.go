@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/printer"
 	"go/token"
@@ -35,6 +36,7 @@ var (
 	acQuitting = false
 	acWg       = sync.WaitGroup{}
 	acListener net.Listener
+	acGodoc    *godocHandler
 )
 
 func act(ac Action) {
@@ -87,6 +89,15 @@ func parseAstFile(fn string, s string, mode parser.Mode) (fset *token.FileSet, a
 	return
 }
 
+// readSrc returns s if it's not empty, otherwise the contents of the file fn
+func readSrc(fn string, s string) (string, error) {
+	if s != "" || fn == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(fn)
+	return string(b), err
+}
+
 type ActionFunc func(r Request) (data, error)
 
 type Action struct {
@@ -117,6 +128,11 @@ func serve(rw http.ResponseWriter, req *http.Request) {
 	acWg.Add(1)
 	defer acWg.Done()
 
+	if acGodoc != nil && strings.HasPrefix(req.URL.Path, acGodoc.prefix) {
+		acGodoc.ServeHTTP(rw, req)
+		return
+	}
+
 	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
 	r := Request{
 		Rw:  rw,
@@ -166,6 +182,51 @@ func printSrc(fset *token.FileSet, v interface{}, tabIndent bool, tabWidth int)
 	return
 }
 
+func envGoroot(env map[string]string) string {
+	if len(env) > 0 && env["GOROOT"] != "" {
+		return env["GOROOT"]
+	} else if fn := os.Getenv("GOROOT"); fn != "" {
+		return fn
+	}
+	return runtime.GOROOT()
+}
+
+// buildContext returns a copy of build.Default configured by GOROOT, GOPATH, GOOS, GOARCH and CGO_ENABLED in env
+// and the additional build tags
+func buildContext(env map[string]string, tags []string) build.Context {
+	ctx := build.Default
+	ctx.GOROOT = envGoroot(env)
+	if len(env) > 0 {
+		if s := env["GOPATH"]; s != "" {
+			ctx.GOPATH = s
+		}
+		if s := env["GOOS"]; s != "" {
+			ctx.GOOS = s
+		}
+		if s := env["GOARCH"]; s != "" {
+			ctx.GOARCH = s
+		}
+		if s := env["CGO_ENABLED"]; s != "" {
+			ctx.CgoEnabled = s == "1"
+		} else if ctx.GOOS != runtime.GOOS || ctx.GOARCH != runtime.GOARCH {
+			// like the go tool, cgo is disabled by default when cross-compiling
+			ctx.CgoEnabled = false
+		}
+	}
+	ctx.BuildTags = append(append([]string{}, ctx.BuildTags...), tags...)
+	return ctx
+}
+
+// gorootSrc returns the directory containing the standard library's source.
+// It's GOROOT/src/pkg before go1.4 and GOROOT/src since
+func gorootSrc(goroot string) string {
+	dir := filepath.Join(goroot, "src", "pkg")
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		return dir
+	}
+	return filepath.Join(goroot, "src")
+}
+
 func rootDirs(env map[string]string) []string {
 	dirs := []string{}
 	gopath := ""
@@ -175,13 +236,8 @@ func rootDirs(env map[string]string) []string {
 		gopath = env["GOPATH"]
 	}
 
-	gorootBase := runtime.GOROOT()
-	if len(env) > 0 && env["GOROOT"] != "" {
-		gorootBase = env["GOROOT"]
-	} else if fn := os.Getenv("GOROOT"); fn != "" {
-		gorootBase = fn
-	}
-	goroot := filepath.Join(gorootBase, "src", "pkg")
+	gorootBase := envGoroot(env)
+	goroot := gorootSrc(gorootBase)
 
 	dirsSeen := map[string]bool{}
 	for _, fn := range filepath.SplitList(gopath) {
@@ -246,6 +302,7 @@ func main() {
 	d := flag.Bool("d", false, "Whether or not to launch in the background(like a daemon)")
 	closeFds := flag.Bool("close-fds", false, "Whether or not to close stdin, stdout and stderr")
 	addr := flag.String("addr", defaultAddr, "The tcp address to listen on")
+	godoc := flag.String("godoc", "/godoc/", "The path prefix under which package documentation is served, or empty to disable it")
 	call := flag.String("call", "",
 		"Call the specified command:"+
 			"\n\t\tdefault-addr: output the default address"+
@@ -273,6 +330,7 @@ func main() {
 		cmd := exec.Command(os.Args[0],
 			"-close-fds",
 			"-addr", *addr,
+			"-godoc", *godoc,
 			"-call", *call,
 		)
 		serr, err := cmd.StderrPipe()
@@ -312,9 +370,17 @@ func main() {
 
 		go func() {
 			importPaths(map[string]string{})
+			importUsage(map[string]string{})
 			pkgDirs(nil)
 		}()
 
+		if *godoc != "" {
+			acGodoc = &godocHandler{
+				prefix: path.Clean("/"+*godoc) + "/",
+				env:    godocEnv(),
+			}
+		}
+
 		err = http.Serve(acListener, http.HandlerFunc(serve))
 		if !acQuitting && err != nil {
 			log.Fatalln(err)
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"go/scanner"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+type srcToken struct {
+	tok   token.Token
+	lit   string
+	start int
+	end   int
+}
+
+func (t srcToken) eq(u srcToken) bool {
+	if t.tok != u.tok {
+		return false
+	}
+	if t.tok == token.COMMENT {
+		// comments may be re-indented so we only compare their words
+		return strings.Join(strings.Fields(t.lit), " ") == strings.Join(strings.Fields(u.lit), " ")
+	}
+	return t.lit == u.lit
+}
+
+// scanTokens returns the list of tokens in src, including comments but excluding automatically inserted semi-colons
+func scanTokens(src string) []srcToken {
+	toks := []srcToken{}
+	fset := token.NewFileSet()
+	f := fset.AddFile("", fset.Base(), len(src))
+	s := scanner.Scanner{}
+	s.Init(f, []byte(src), nil, scanner.ScanComments)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.SEMICOLON && lit != ";" {
+			continue
+		}
+		if lit == "" {
+			lit = tok.String()
+		}
+		start := f.Offset(pos)
+		end := start + len(lit)
+		if end > len(src) {
+			end = len(src)
+		}
+		toks = append(toks, srcToken{
+			tok:   tok,
+			lit:   lit,
+			start: start,
+			end:   end,
+		})
+	}
+	return toks
+}
+
+// mapOffsets translates each byte offset in src to the corresponding offset in dst.
+// The tokens of both sources are aligned and each offset is placed relative to the closest token preceding it
+// so e.g. the cursor stays inside the same identifier, or in the same whitespace after it.
+func mapOffsets(src, dst string, offsets []int) []int {
+	res := make([]int, len(offsets))
+	if len(offsets) == 0 {
+		return res
+	}
+
+	ta := scanTokens(src)
+	tb := scanTokens(dst)
+	matched := make([]int, len(ta))
+	for i, _ := range matched {
+		matched[i] = -1
+	}
+	for _, mt := range diffSeq(len(ta), len(tb), func(i, j int) bool { return ta[i].eq(tb[j]) }) {
+		matched[mt[0]] = mt[1]
+	}
+
+	for n, o := range offsets {
+		// the last token that starts at or before the offset
+		i := sort.Search(len(ta), func(i int) bool { return ta[i].start > o }) - 1
+		inside := i >= 0 && o < ta[i].end && matched[i] >= 0
+		for i >= 0 && matched[i] < 0 {
+			i -= 1
+		}
+
+		p := 0
+		if i < 0 {
+			p = o
+			if len(tb) > 0 && p > tb[0].start {
+				p = tb[0].start
+			}
+		} else {
+			a, b := ta[i], tb[matched[i]]
+			if inside {
+				p = b.start + (o - a.start)
+				if p > b.end {
+					p = b.end
+				}
+			} else {
+				next := len(dst)
+				if j := matched[i] + 1; j < len(tb) {
+					next = tb[j].start
+				}
+				p = b.end + maxInt(0, o-a.end)
+				if p > next {
+					p = next
+				}
+			}
+		}
+
+		if p < 0 {
+			p = 0
+		} else if p > len(dst) {
+			p = len(dst)
+		}
+		res[n] = p
+	}
+	return res
+}
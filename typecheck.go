@@ -0,0 +1,535 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// all type-checking shares a single FileSet so that the positions of objects in cached packages remain valid.
+	// the lock guards the cache and the files, which the importer reads and updates while a package is checked,
+	// and the cached packages themselves, so only one package is checked at a time.
+	// the files are keyed by their token.File because the same file is parsed again each time it's checked
+	typeCheckLck   = sync.Mutex{}
+	typeCheckFset  = token.NewFileSet()
+	typeCheckCache = map[string]*typeCheckEnt{}
+	typeCheckFiles = map[*token.File]*ast.File{}
+	typeCheckBytes = 0
+)
+
+// once the files that were parsed add up to this many bytes of source, the FileSet, the files and the cache
+// are dropped and start over. their ASTs take up roughly ten times as much memory
+const typeCheckMaxBytes = 32 << 20
+
+// typeCheckEnt is a type-checked dependency. Dependencies are checked from source, ignoring function bodies.
+// stamps records the state of the package dir and each of its files when it was checked, and deps the entries
+// of the packages it imports, keyed by dir. The entry is stale if any of them has changed since
+type typeCheckEnt struct {
+	stamps map[string]fileStamp
+	deps   map[string]*typeCheckEnt
+	pkg    *types.Package
+	err    error
+}
+
+// fileStamp is used to tell whether a file has changed
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func (st fileStamp) same(o fileStamp) bool {
+	return st.size == o.size && st.modTime.Equal(o.modTime)
+}
+
+func statFileStamp(fn string) fileStamp {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+	}
+}
+
+// typeCheckPkg is the result of type-checking the package containing a file
+type typeCheckPkg struct {
+	Fset  *token.FileSet
+	Pkg   *types.Package
+	Info  *types.Info
+	File  *ast.File
+	Files []*ast.File
+}
+
+// srcImporter is a types.ImporterFrom that type-checks packages from source using a build.Context.
+// overlay maps filenames to their (unsaved) contents
+type srcImporter struct {
+	ctx     build.Context
+	overlay map[string]string
+	seen    map[string]bool
+	// the dependencies of each package that's being checked, innermost last
+	deps []map[string]*typeCheckEnt
+	// the packages imported so far, so each is only checked once even if it can't be cached
+	imported map[string]*typeCheckEnt
+	// whether the cache entry of each dir has been found to be up to date during this import
+	fresh map[string]bool
+}
+
+func (imp *srcImporter) Import(path string) (*types.Package, error) {
+	return imp.ImportFrom(path, "", 0)
+}
+
+func (imp *srcImporter) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	if path == "C" {
+		return nil, errors.New(`import "C" is handled by the type checker`)
+	}
+
+	bp, err := ctxImport(imp.ctx, path, srcDir, 0)
+	if err != nil && bp == nil {
+		return nil, err
+	}
+	if bp.Dir == "" {
+		return nil, fmt.Errorf("cannot find package %s", path)
+	}
+
+	if _, err := os.Stat(bp.Dir); err != nil {
+		return nil, err
+	}
+	if ent := imp.imported[bp.Dir]; ent != nil {
+		imp.addDep(bp.Dir, ent)
+		return ent.pkg, ent.err
+	}
+	if ent := imp.cached(bp.Dir); ent != nil {
+		imp.imported[bp.Dir] = ent
+		imp.addDep(bp.Dir, ent)
+		return ent.pkg, ent.err
+	}
+
+	if imp.seen[bp.Dir] {
+		return nil, fmt.Errorf("import cycle via %s", path)
+	}
+	imp.seen[bp.Dir] = true
+	defer delete(imp.seen, bp.Dir)
+
+	// the files are stat'ed before they're read so a change made while they're checked is seen next time
+	ent := &typeCheckEnt{
+		stamps: map[string]fileStamp{bp.Dir: statFileStamp(bp.Dir)},
+		deps:   map[string]*typeCheckEnt{},
+	}
+	fns := []string{}
+	for _, l := range [][]string{bp.GoFiles, bp.CgoFiles} {
+		for _, fn := range l {
+			fn = filepath.Join(bp.Dir, fn)
+			fns = append(fns, fn)
+			ent.stamps[fn] = statFileStamp(fn)
+		}
+	}
+	files := imp.parseFiles(fns)
+
+	conf := types.Config{
+		Importer:         imp,
+		FakeImportC:      true,
+		IgnoreFuncBodies: true,
+		Sizes:            types.SizesFor("gc", imp.ctx.GOARCH),
+		Error:            func(error) {},
+	}
+	imp.deps = append(imp.deps, ent.deps)
+	ent.pkg, ent.err = conf.Check(bp.ImportPath, typeCheckFset, files, nil)
+	imp.deps = imp.deps[:len(imp.deps)-1]
+	if ent.pkg != nil {
+		// errors in dependencies are not fatal, we'll make do with whatever could be checked
+		ent.err = nil
+	}
+
+	// packages whose contents are overlaid, or that depend on one, are only valid for this import
+	cacheable := !imp.overlaid(bp.Dir)
+	for dir, dep := range ent.deps {
+		if typeCheckCache[dir] != dep {
+			cacheable = false
+		}
+	}
+	if cacheable {
+		typeCheckCache[bp.Dir] = ent
+		imp.fresh[bp.Dir] = true
+	}
+	imp.imported[bp.Dir] = ent
+	imp.addDep(bp.Dir, ent)
+	return ent.pkg, ent.err
+}
+
+// addDep records ent, the package in dir, as a dependency of the package that's being checked
+func (imp *srcImporter) addDep(dir string, ent *typeCheckEnt) {
+	if n := len(imp.deps); n != 0 {
+		imp.deps[n-1][dir] = ent
+	}
+}
+
+// overlaid reports whether the contents of any of the files in dir are overlaid
+func (imp *srcImporter) overlaid(dir string) bool {
+	for fn, _ := range imp.overlay {
+		if filepath.Dir(fn) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// cached returns the cache entry of the package in dir if neither its files nor its dependencies have changed
+// since it was checked. Stale entries are removed, which in turn makes the entries of their importers stale.
+// Entries that are overlaid, or depend on one that is, are kept but not used
+func (imp *srcImporter) cached(dir string) *typeCheckEnt {
+	ent := typeCheckCache[dir]
+	if ent == nil {
+		return nil
+	}
+	if fresh, ok := imp.fresh[dir]; ok {
+		if fresh {
+			return ent
+		}
+		return nil
+	}
+
+	// it's marked unusable while it's validated in case of an import cycle
+	imp.fresh[dir] = false
+	stale := false
+	for fn, st := range ent.stamps {
+		if !statFileStamp(fn).same(st) {
+			stale = true
+			break
+		}
+	}
+	fresh := !stale && !imp.overlaid(dir)
+	for depDir, dep := range ent.deps {
+		if stale {
+			break
+		}
+		if imp.cached(depDir) != dep {
+			fresh = false
+			stale = typeCheckCache[depDir] != dep
+		}
+	}
+	if stale {
+		delete(typeCheckCache, dir)
+		return nil
+	}
+	imp.fresh[dir] = fresh
+	if !fresh {
+		return nil
+	}
+	return ent
+}
+
+// ctxImport imports path relative to srcDir like ctx.Import, but always resolves it the way the go command would
+// i.e. using the module containing srcDir, or GOPATH if there isn't one
+func ctxImport(ctx build.Context, path, srcDir string, mode build.ImportMode) (*build.Package, error) {
+	if modRoot, _ := findModule(srcDir); modRoot == "" {
+		// outside of a module, imports are resolved using GOPATH.
+		// setting any of the file system hooks stops go/build from delegating to the go command
+		ctx.JoinPath = filepath.Join
+	} else {
+		// the go command is run in ctx.Dir, so it must be inside the module
+		ctx.Dir = srcDir
+	}
+	return ctx.Import(path, srcDir, mode)
+}
+
+func (imp *srcImporter) parseFiles(fns []string) []*ast.File {
+	files := []*ast.File{}
+	for _, fn := range fns {
+		var src interface{}
+		if s, ok := imp.overlay[fn]; ok {
+			src = s
+		}
+		af, _ := parser.ParseFile(typeCheckFset, fn, src, parser.ParseComments)
+		if af != nil {
+			tf := typeCheckFset.File(af.Package)
+			files = append(files, af)
+			typeCheckFiles[tf] = af
+			typeCheckBytes += tf.Size()
+		}
+	}
+	return files
+}
+
+// typeCheck type-checks the package containing the file fn whose content is src (if not empty).
+// The contents of other files may be overridden by overlay. Errors are ignored, so the result is usable
+// as long as the file fn could be parsed
+func typeCheck(env map[string]string, fn, src string, overlay map[string]string) (*typeCheckPkg, error) {
+	typeCheckLck.Lock()
+	defer typeCheckLck.Unlock()
+
+	typeCheckEvict()
+
+	if fn == "" {
+		fn = "<stdin>"
+	}
+	if fn != "<stdin>" {
+		fn, _ = filepath.Abs(fn)
+	}
+	ov := map[string]string{}
+	for k, v := range overlay {
+		ov[k] = v
+	}
+	if src != "" {
+		ov[fn] = src
+	}
+
+	imp := &srcImporter{
+		ctx:      buildContext(env, nil),
+		overlay:  ov,
+		seen:     map[string]bool{},
+		fresh:    map[string]bool{},
+		imported: map[string]*typeCheckEnt{},
+	}
+
+	files := imp.parseFiles([]string{fn})
+	if len(files) == 0 {
+		return nil, fmt.Errorf("cannot parse %s", fn)
+	}
+	af := files[0]
+
+	dir := filepath.Dir(fn)
+	if fn != "<stdin>" {
+		if bp, _ := imp.ctx.ImportDir(dir, 0); bp != nil {
+			pkgName := af.Name.Name
+			l := [][]string{}
+			switch {
+			case strings.HasSuffix(pkgName, "_test") && pkgName != bp.Name:
+				l = append(l, bp.XTestGoFiles)
+			case strings.HasSuffix(fn, "_test.go"):
+				l = append(l, bp.GoFiles, bp.CgoFiles, bp.TestGoFiles)
+			default:
+				l = append(l, bp.GoFiles, bp.CgoFiles)
+			}
+
+			fns := []string{}
+			for _, names := range l {
+				for _, name := range names {
+					if p := filepath.Join(dir, name); p != fn {
+						fns = append(fns, p)
+					}
+				}
+			}
+			for _, f := range imp.parseFiles(fns) {
+				if f.Name.Name == pkgName {
+					files = append(files, f)
+				}
+			}
+		}
+	}
+
+	info := &types.Info{
+		Types:      map[ast.Expr]types.TypeAndValue{},
+		Defs:       map[*ast.Ident]types.Object{},
+		Uses:       map[*ast.Ident]types.Object{},
+		Implicits:  map[ast.Node]types.Object{},
+		Selections: map[*ast.SelectorExpr]*types.Selection{},
+		Scopes:     map[ast.Node]*types.Scope{},
+	}
+	conf := types.Config{
+		Importer:    imp,
+		FakeImportC: true,
+		Sizes:       types.SizesFor("gc", imp.ctx.GOARCH),
+		Error:       func(error) {},
+	}
+
+	importPath := dirImportPath(imp.ctx, dir)
+	if importPath == "" {
+		importPath = af.Name.Name
+	}
+	if strings.HasSuffix(af.Name.Name, "_test") && !strings.HasSuffix(importPath, "_test") {
+		importPath += "_test"
+	}
+	pkg, _ := conf.Check(importPath, typeCheckFset, files, info)
+	if pkg == nil {
+		return nil, fmt.Errorf("cannot type-check %s", fn)
+	}
+
+	return &typeCheckPkg{
+		Fset:  typeCheckFset,
+		Pkg:   pkg,
+		Info:  info,
+		File:  af,
+		Files: files,
+	}, nil
+}
+
+// typeCheckEvict drops the shared FileSet, along with the files and packages whose positions refer to it,
+// once too much source has been parsed. The results of earlier checks keep their own reference to the FileSet
+// so they remain usable, but the declarations of their objects can no longer be found by typeObjDecl.
+// It must be called with typeCheckLck held
+func typeCheckEvict() {
+	if typeCheckBytes < typeCheckMaxBytes {
+		return
+	}
+	typeCheckFset = token.NewFileSet()
+	typeCheckCache = map[string]*typeCheckEnt{}
+	typeCheckFiles = map[*token.File]*ast.File{}
+	typeCheckBytes = 0
+}
+
+// dirImportPath returns the import path of the package in dir, or an empty string if it's not in GOPATH, GOROOT or a module
+func dirImportPath(ctx build.Context, dir string) string {
+	if bp, err := ctx.ImportDir(dir, build.FindOnly); err == nil && bp.ImportPath != "" && bp.ImportPath != "." {
+		return bp.ImportPath
+	}
+	if modRoot, modPath := findModule(dir); modRoot != "" {
+		if rel, err := filepath.Rel(modRoot, dir); err == nil {
+			return path.Join(modPath, filepath.ToSlash(rel))
+		}
+	}
+	return ""
+}
+
+// typeCheckImport type-checks the package with the import path importPath, resolved relative to srcDir,
+// the way dependencies are i.e. ignoring function bodies and using the cache.
+// The objects in the package are the same as those seen by packages that import it, that are checked by typeCheck
+func typeCheckImport(env map[string]string, importPath, srcDir string) (*types.Package, error) {
+	typeCheckLck.Lock()
+	defer typeCheckLck.Unlock()
+
+	imp := &srcImporter{
+		ctx:      buildContext(env, nil),
+		overlay:  map[string]string{},
+		seen:     map[string]bool{},
+		fresh:    map[string]bool{},
+		imported: map[string]*typeCheckEnt{},
+	}
+	return imp.ImportFrom(importPath, srcDir, 0)
+}
+
+// typeCheckDir type-checks the package in dir along with its tests, and its external test package if there is one.
+// Packages containing any of the files in checked, which was already type-checked, are not checked again
+func typeCheckDir(env map[string]string, dir string, overlay map[string]string, checked *typeCheckPkg) []*typeCheckPkg {
+	l := []*typeCheckPkg{}
+	ctx := buildContext(env, nil)
+	bp, _ := ctx.ImportDir(dir, 0)
+	if bp == nil {
+		return l
+	}
+
+	fns := []string{}
+	for _, names := range [][]string{bp.TestGoFiles, bp.GoFiles, bp.CgoFiles} {
+		if len(names) != 0 {
+			fns = append(fns, names[0])
+			break
+		}
+	}
+	if len(bp.XTestGoFiles) != 0 {
+		fns = append(fns, bp.XTestGoFiles[0])
+	}
+	done := map[string]bool{}
+	if checked != nil {
+		for _, af := range checked.Files {
+			done[checked.Fset.Position(af.Package).Filename] = true
+		}
+	}
+	for _, fn := range fns {
+		fn = filepath.Join(dir, fn)
+		if done[fn] {
+			continue
+		}
+		if tc, err := typeCheck(env, fn, "", overlay); err == nil {
+			l = append(l, tc)
+		}
+	}
+	return l
+}
+
+// typeObjKey returns a key that identifies obj across separate type-checks of the package it's declared in.
+// Objects are identified by the position of their declaration, and instantiated generic objects by their origin
+func typeObjKey(fset *token.FileSet, obj types.Object) string {
+	switch v := obj.(type) {
+	case *types.Func:
+		obj = v.Origin()
+	case *types.Var:
+		obj = v.Origin()
+	}
+	if !obj.Pos().IsValid() {
+		return ""
+	}
+	tp := fset.Position(obj.Pos())
+	return typeObjKeyPos(tp.Filename, tp.Offset)
+}
+
+func typeObjKeyPos(fn string, offset int) string {
+	return fmt.Sprintf("%s:%d", fn, offset)
+}
+
+// typeObjDecl returns the declaration of obj as an ast.Object, and the file it's declared in.
+// nil is returned if the declaration is not in any of the files seen by the type checker
+func typeObjDecl(fset *token.FileSet, obj types.Object) (*ast.Object, *ast.File) {
+	if obj == nil || !obj.Pos().IsValid() {
+		return nil, nil
+	}
+	af := typeCheckFiles[fset.File(obj.Pos())]
+	if af == nil {
+		return nil, nil
+	}
+
+	var decl interface{}
+	path := []ast.Node{}
+	ast.Inspect(af, func(n ast.Node) bool {
+		if decl != nil {
+			return false
+		}
+		if n == nil {
+			path = path[:len(path)-1]
+			return false
+		}
+		if n.End() < obj.Pos() || n.Pos() > obj.Pos() {
+			return false
+		}
+		if id, ok := n.(*ast.Ident); ok && id.Pos() == obj.Pos() {
+			for i := len(path) - 1; i >= 0 && decl == nil; i-- {
+				switch v := path[i].(type) {
+				case *ast.FuncDecl, *ast.TypeSpec, *ast.ValueSpec, *ast.Field, *ast.AssignStmt,
+					*ast.LabeledStmt, *ast.ImportSpec:
+					decl = v
+				}
+			}
+			return false
+		}
+		path = append(path, n)
+		return true
+	})
+	if decl == nil {
+		return nil, nil
+	}
+
+	o := &ast.Object{
+		Name: obj.Name(),
+		Decl: decl,
+	}
+	switch obj.(type) {
+	case *types.Func:
+		o.Kind = ast.Fun
+	case *types.Var:
+		o.Kind = ast.Var
+	case *types.Const:
+		o.Kind = ast.Con
+	case *types.TypeName:
+		o.Kind = ast.Typ
+	case *types.Label:
+		o.Kind = ast.Lbl
+	case *types.PkgName:
+		o.Kind = ast.Pkg
+	default:
+		return nil, nil
+	}
+	return o, af
+}